@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// isAdmin reports whether the request carries ADMIN_TOKEN as a bearer token.
+func (s *server) isAdmin(c *gin.Context) bool {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return found && s.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) == 1
+}
+
+// bypassCache reports whether the request asked with nocache=1 to render the image again.
+// It needs the admin token unless ALLOW_ANONYMOUS_NOCACHE is set.
+func (s *server) bypassCache(c *gin.Context) bool {
+	return c.Query("nocache") == "1" && (s.cfg.AllowAnonymousNocache || s.isAdmin(c))
+}
+
+// adminMiddleware only lets through requests carrying ADMIN_TOKEN as a bearer token.
+func (s *server) adminMiddleware(c *gin.Context) {
+	if !s.isAdmin(c) {
+		c.Header("WWW-Authenticate", "Bearer")
+		abort(c, http.StatusUnauthorized, "Invalid admin token", nil)
+		c.Abort()
+		return
+	}
+}
+
+func (s *server) clearCacheHandler(c *gin.Context) {
+	if err := errors.Join(s.cache.Clear(), s.clearRemoteImages()); err != nil {
+		abort(c, http.StatusInternalServerError, "Failed to clear cache", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (s *server) invalidateCacheHandler(c *gin.Context) {
+	filename := c.Param("filename")[1:]
+	removed, err := s.cache.Invalidate(filename)
+	if err == nil && isRemote(filename) {
+		err = s.removeRemoteImage(filename)
+	}
+	if err != nil {
+		abort(c, http.StatusInternalServerError, "Failed to invalidate cache", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNocacheNeedsAdminToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		anonymous bool
+		headers   []string
+		bypassed  bool
+	}{
+		{"anonymous", false, nil, false},
+		{"wrong token", false, []string{"Authorization", "Bearer wrong"}, false},
+		{"admin token", false, []string{"Authorization", "Bearer secret"}, true},
+		{"anonymous allowed", true, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, func(cfg *config) {
+				cfg.AdminToken = "secret"
+				cfg.AllowAnonymousNocache = test.anonymous
+			})
+			writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+			get(s, "/info/grayscale/photo.png")
+
+			info := get(s, "/info/grayscale/photo.png?nocache=1", test.headers...)
+			if bypassed := strings.Contains(info.Body.String(), `"cache_hit":false`); bypassed != test.bypassed {
+				t.Errorf("got bypassed %v, want %v: %s", bypassed, test.bypassed, info.Body)
+			}
+		})
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.AdminToken = "secret" })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	writeImage(t, s.cfg.ImageDir, "other.png", gradient(40, 30))
+	for _, path := range []string{"/images/resize=20/photo.png", "/images/grayscale/photo.png", "/images/grayscale/other.png"} {
+		decodeBody(t, get(s, path))
+	}
+
+	if rec := request(s, http.MethodDelete, "/cache/photo.png"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the token got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := request(s, http.MethodDelete, "/cache/photo.png", "Authorization", "Bearer secret")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"removed":2`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := map[string]bool{
+		"/info/resize=20/photo.png": false,
+		"/info/grayscale/photo.png": false,
+		"/info/grayscale/other.png": true,
+	}
+	for path, cached := range tests {
+		if info := get(s, path); !strings.Contains(info.Body.String(), fmt.Sprintf(`"cache_hit":%v`, cached)) {
+			t.Errorf("%s got %s, want cache_hit %v", path, info.Body, cached)
+		}
+	}
+}
+
+func TestClearCacheRemovesRemoteImagesWithAnyBackend(t *testing.T) {
+	var hits atomic.Int32
+	origin := imageServer(t, &hits)
+	s := newTestServer(t, func(cfg *config) {
+		cfg.AdminToken = "secret"
+		cfg.RemoteHosts = []string{"localhost"}
+	})
+	// the downloads stay in cacheDir when rendered images are kept elsewhere, as with redis
+	s.cache = newFakeCache()
+	rawURL := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/photo.png"
+	decodeBody(t, get(s, remotePath("grayscale", rawURL)))
+
+	if rec := request(s, http.MethodDelete, "/cache", "Authorization", "Bearer secret"); rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(s.remoteImagePath(rawURL)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("download was kept: %v", err)
+	}
+	decodeBody(t, get(s, remotePath("grayscale", rawURL)))
+	if hits.Load() != 2 {
+		t.Errorf("origin was hit %d times, want 2", hits.Load())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+type cachedBlurHash struct {
+	modTime time.Time
+	hash    string
+}
+
+func (s *server) blurHashHandler(c *gin.Context) {
+	filename := c.Param("filename")[1:]
+
+	xComponents, err := strconv.Atoi(c.DefaultQuery("x", "4"))
+	if err != nil || xComponents < 1 || xComponents > 9 {
+		abort(c, http.StatusBadRequest, "x must be between 1 and 9", nil)
+		return
+	}
+	yComponents, err := strconv.Atoi(c.DefaultQuery("y", "3"))
+	if err != nil || yComponents < 1 || yComponents > 9 {
+		abort(c, http.StatusBadRequest, "y must be between 1 and 9", nil)
+		return
+	}
+
+	// remote images have no modification time, so only their download is cached
+	_, modified := s.sourceVersion(c.Request.Context(), filename)
+	key := fmt.Sprintf("%s\x00%d\x00%d", filename, xComponents, yComponents)
+	if cached, exists := s.blurHashes.Load(key); exists && !modified.IsZero() && cached.(cachedBlurHash).modTime.Equal(modified) {
+		c.Set("cache_hit", true)
+		c.JSON(http.StatusOK, gin.H{"blurhash": cached.(cachedBlurHash).hash})
+		return
+	}
+	if !s.limiter.allow(c) {
+		return
+	}
+
+	data, err := s.readSource(c.Request.Context(), filename)
+	if err != nil {
+		sourceError(filename, err).abort(c)
+		return
+	}
+	img, srcFormat, err := s.decodeImage(data, true)
+	if err != nil {
+		decodeError(err).abort(c)
+		return
+	}
+	if !s.cfg.allowsType("image/" + srcFormat) {
+		abort(c, http.StatusUnsupportedMediaType, "Image type not allowed", nil)
+		return
+	}
+
+	hash := encodeBlurHash(imaging.Fit(img, 64, 64, imaging.Box), xComponents, yComponents)
+	if !modified.IsZero() {
+		s.blurHashes.Store(key, cachedBlurHash{modTime: modified, hash: hash})
+	}
+	c.JSON(http.StatusOK, gin.H{"blurhash": hash})
+}
+
+// encodeBlurHash implements the encoder from https://github.com/woltapp/blurhash.
+func encodeBlurHash(img *image.NRGBA, xComponents, yComponents int) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					p := img.PixOffset(x, y)
+					factor[0] += basis * sRGBToLinear(img.Pix[p])
+					factor[1] += basis * sRGBToLinear(img.Pix[p+1])
+					factor[2] += basis * sRGBToLinear(img.Pix[p+2])
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, factor := range factors[1:] {
+		quantise := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
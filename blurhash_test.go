@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEncodeBlurHash(t *testing.T) {
+	if got := encodeBlurHash(imaging.New(8, 8, color.NRGBA{255, 0, 0, 255}), 1, 1); got != "00TI:j" {
+		t.Errorf("solid red got %q, want 00TI:j", got)
+	}
+
+	const width, height = 32, 24
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / (width - 1)), uint8(y * 255 / (height - 1)), 128, 255})
+		}
+	}
+	if got, want := encodeBlurHash(img, 4, 3), "L$HewF2swxX8l}WDjte;gJfjfQfj"; got != want {
+		t.Errorf("gradient got %q, want %q", got, want)
+	}
+}
+
+func TestBlurHashHandler(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "red.png", imaging.New(20, 20, color.NRGBA{255, 0, 0, 255}))
+
+	if rec := get(s, "/blurhash/red.png?x=1&y=1"); !strings.Contains(rec.Body.String(), `"blurhash":"00TI:j"`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/blurhash/red.png?x=10"); rec.Code != http.StatusBadRequest {
+		t.Errorf("x=10 got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBlurHashErrorsMatchImages(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.MaxSourceSizeMB = 1 })
+	writeFile(t, s.cfg.ImageDir, "large.png", make([]byte, 2<<20))
+
+	for _, name := range []string{"large.png", "missing.png"} {
+		images, blurHash := get(s, "/images/grayscale/"+name), get(s, "/blurhash/"+name)
+		if images.Code == http.StatusOK || blurHash.Code != images.Code {
+			t.Errorf("%s got status %d from /blurhash and %d from /images", name, blurHash.Code, images.Code)
+		}
+	}
+}
+
+func TestBlurHashOfRemoteImage(t *testing.T) {
+	var hits atomic.Int32
+	origin := imageServer(t, &hits)
+	s := newTestServer(t, func(cfg *config) { cfg.RemoteHosts = []string{"localhost"} })
+
+	if rec := get(s, "/blurhash/"+remoteFilename(origin.URL+"/photo.png")); rec.Code != http.StatusOK {
+		t.Errorf("allowed host got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/blurhash/"+url.PathEscape(origin.URL+"/photo.png")); rec.Code != http.StatusForbidden {
+		t.Errorf("host not on the list got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// redisKeyPrefix namespaces cache keys so clearing the cache leaves other keys in the database alone.
+const redisKeyPrefix = "goimagen:"
+
+// metaSuffix names the sidecar file describing a cached image.
+const metaSuffix = ".meta"
+
+// CacheBackend stores encoded images by cache key.
+type CacheBackend interface {
+	// Get returns a cached image and how it was made, the meta is empty when a backend lost it.
+	Get(key string) ([]byte, cacheMeta, bool)
+	Set(key string, data []byte, meta cacheMeta) error
+	// Delete removes a single entry, deleting one that isn't cached is not an error.
+	Delete(key string) error
+	Clear() error
+	// Invalidate removes the entries rendered from filename and returns how many there were.
+	Invalidate(filename string) (int, error)
+}
+
+// cacheMeta describes how a cached image was made.
+type cacheMeta struct {
+	Filename    string    `json:"filename"`
+	Operations  string    `json:"operations"`
+	ContentType string    `json:"contentType"`
+	Created     time.Time `json:"created"`
+	TTL         int       `json:"ttl"` // seconds, 0 never expires
+}
+
+// expired reports whether an entry created at meta.Created is older than ttl at now, a ttl of zero
+// never expires.
+func (meta cacheMeta) expired(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(meta.Created) > ttl
+}
+
+// fileCache keeps images in a local directory. Entries older than ttl, going by the time
+// recorded in their sidecar, are treated as missing so they are rendered again, a ttl of zero
+// never expires them. They may be evicted sooner.
+type fileCache struct {
+	dir   string
+	ttl   time.Duration
+	index *cacheIndex
+	now   func() time.Time
+}
+
+func (f fileCache) Get(key string) ([]byte, cacheMeta, bool) {
+	path := filepath.Join(f.dir, key)
+	var meta cacheMeta
+	encoded, err := os.ReadFile(path + metaSuffix)
+	if err != nil || json.Unmarshal(encoded, &meta) != nil || meta.expired(f.ttl, f.now()) {
+		return nil, cacheMeta{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, cacheMeta{}, false
+	}
+	f.index.used(path)
+	return data, meta, true
+}
+
+func (f fileCache) Set(key string, data []byte, meta cacheMeta) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// the image goes first so a sidecar never describes a missing image, each is renamed
+	// into place whole so Get never reads a partly written file.
+	if err := f.write(key, data); err != nil {
+		return err
+	}
+	if err := f.write(key+metaSuffix, encoded); err != nil {
+		os.Remove(filepath.Join(f.dir, key))
+		return err
+	}
+	f.index.added(filepath.Join(f.dir, key), int64(len(data)+len(encoded)))
+	return nil
+}
+
+func (f fileCache) write(name string, data []byte) error {
+	file, err := os.CreateTemp(f.dir, ".cache-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err = file.Chmod(0644); err == nil {
+		_, err = file.Write(data)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(f.dir, name))
+}
+
+func (f fileCache) Delete(key string) error {
+	path := filepath.Join(f.dir, key)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f.index.removed(path)
+	if err := os.Remove(path + metaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Clear removes everything in the directory, downloaded remote images included.
+func (f fileCache) Clear() error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		errs = append(errs, os.RemoveAll(filepath.Join(f.dir, entry.Name())))
+	}
+	if f.index != nil {
+		errs = append(errs, f.index.rescan())
+	}
+	return errors.Join(errs...)
+}
+
+func (f fileCache) Invalidate(filename string) (int, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	var errs []error
+	for _, entry := range entries {
+		key, isMeta := strings.CutSuffix(entry.Name(), metaSuffix)
+		if !isMeta || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(f.dir, entry.Name()))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var meta cacheMeta
+		if json.Unmarshal(data, &meta) != nil || meta.Filename != filename {
+			continue
+		}
+		if err := f.Delete(key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// redisCache shares images between instances, a ttl of zero keeps them until redis evicts them.
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache(url string) (*redisCache, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: redis.NewClient(options)}, nil
+}
+
+func (r *redisCache) Get(key string) ([]byte, cacheMeta, bool) {
+	values, err := r.client.MGet(context.Background(), redisKeyPrefix+key, redisKeyPrefix+key+metaSuffix).Result()
+	if err != nil {
+		slog.Warn("Failed to read from redis", "error", err)
+		return nil, cacheMeta{}, false
+	}
+	data, exists := values[0].(string)
+	if !exists {
+		return nil, cacheMeta{}, false
+	}
+	var meta cacheMeta
+	if encoded, exists := values[1].(string); exists {
+		_ = json.Unmarshal([]byte(encoded), &meta)
+	}
+	return []byte(data), meta, true
+}
+
+func (r *redisCache) Set(key string, data []byte, meta cacheMeta) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisKeyPrefix+key, data, time.Duration(meta.TTL)*time.Second)
+		pipe.Set(ctx, redisKeyPrefix+key+metaSuffix, encoded, time.Duration(meta.TTL)*time.Second)
+		return nil
+	})
+	return err
+}
+
+func (r *redisCache) Delete(key string) error {
+	return r.client.Unlink(context.Background(), redisKeyPrefix+key, redisKeyPrefix+key+metaSuffix).Err()
+}
+
+func (r *redisCache) Clear() error {
+	ctx := context.Background()
+	iter := r.client.Scan(ctx, 0, redisKeyPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := r.client.Unlink(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+func (r *redisCache) Invalidate(filename string) (int, error) {
+	ctx := context.Background()
+	removed := 0
+	iter := r.client.Scan(ctx, 0, redisKeyPrefix+"*"+metaSuffix, 1000).Iterator()
+	for iter.Next(ctx) {
+		data, err := r.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var meta cacheMeta
+		if json.Unmarshal(data, &meta) != nil || meta.Filename != filename {
+			continue
+		}
+		if err := r.Delete(strings.TrimPrefix(strings.TrimSuffix(iter.Val(), metaSuffix), redisKeyPrefix)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, iter.Err()
+}
+
+// memoryCache keeps the most recently used images in memory in front of another backend.
+// Entries expire ttl after they were rendered, like in the next backend, a ttl of zero keeps
+// them until evicted. Images larger than maxEntry bytes are left to the next backend, zero
+// holds any size.
+type memoryCache struct {
+	entries  *lru.Cache[string, memoryEntry]
+	maxEntry int
+	ttl      time.Duration
+	now      func() time.Time
+	next     CacheBackend
+}
+
+type memoryEntry struct {
+	data []byte
+	meta cacheMeta
+}
+
+func newMemoryCache(size, maxEntry int, ttl time.Duration, now func() time.Time, next CacheBackend) (*memoryCache, error) {
+	entries, err := lru.New[string, memoryEntry](size)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCache{entries: entries, maxEntry: maxEntry, ttl: ttl, now: now, next: next}, nil
+}
+
+func (m *memoryCache) add(key string, data []byte, meta cacheMeta) {
+	if m.maxEntry == 0 || len(data) <= m.maxEntry {
+		m.entries.Add(key, memoryEntry{data: data, meta: meta})
+	}
+}
+
+func (m *memoryCache) Get(key string) ([]byte, cacheMeta, bool) {
+	if entry, exists := m.entries.Get(key); exists {
+		if !entry.meta.expired(m.ttl, m.now()) {
+			return entry.data, entry.meta, true
+		}
+		m.entries.Remove(key)
+	}
+	data, meta, exists := m.next.Get(key)
+	if exists {
+		m.add(key, data, meta)
+	}
+	return data, meta, exists
+}
+
+func (m *memoryCache) Set(key string, data []byte, meta cacheMeta) error {
+	if err := m.next.Set(key, data, meta); err != nil {
+		return err
+	}
+	m.add(key, data, meta)
+	return nil
+}
+
+func (m *memoryCache) Delete(key string) error {
+	m.entries.Remove(key)
+	return m.next.Delete(key)
+}
+
+func (m *memoryCache) Clear() error {
+	err := m.next.Clear()
+	m.entries.Purge()
+	return err
+}
+
+// Invalidate drops every entry held in memory, they don't record their source filename.
+func (m *memoryCache) Invalidate(filename string) (int, error) {
+	removed, err := m.next.Invalidate(filename)
+	m.entries.Purge()
+	return removed, err
+}
+
+func newCacheBackend(cfg config, index *cacheIndex) (CacheBackend, error) {
+	ttl := time.Duration(cfg.CacheTTL) * time.Second
+	var backend CacheBackend = fileCache{dir: cfg.CacheDir, ttl: ttl, index: index, now: time.Now}
+	if cfg.RedisURL != "" {
+		var err error
+		if backend, err = newRedisCache(cfg.RedisURL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MemoryCacheSize > 0 {
+		return newMemoryCache(cfg.MemoryCacheSize, cfg.MemoryCacheMaxEntryKB<<10, ttl, time.Now, backend)
+	}
+	return backend, nil
+}
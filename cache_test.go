@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCache is an in-memory CacheBackend that counts its reads.
+type fakeCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	gets    int
+}
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{entries: make(map[string]memoryEntry)}
+}
+
+func (f *fakeCache) Get(key string) ([]byte, cacheMeta, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets++
+	entry, exists := f.entries[key]
+	return entry.data, entry.meta, exists
+}
+
+func (f *fakeCache) Set(key string, data []byte, meta cacheMeta) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[key] = memoryEntry{data: data, meta: meta}
+	return nil
+}
+
+func (f *fakeCache) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.entries, key)
+	return nil
+}
+
+func (f *fakeCache) Clear() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.entries)
+	return nil
+}
+
+func (f *fakeCache) Invalidate(filename string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	removed := 0
+	for key, entry := range f.entries {
+		if entry.meta.Filename == filename {
+			delete(f.entries, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct {
+	time time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.time }
+
+func TestFileCacheExpiresByCreated(t *testing.T) {
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := fileCache{dir: t.TempDir(), ttl: time.Minute, now: clock.now}
+	if err := cache.Set("key", []byte("image"), cacheMeta{Filename: "photo.png", Created: clock.time, TTL: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.time = clock.time.Add(time.Minute)
+	data, meta, exists := cache.Get("key")
+	if !exists || string(data) != "image" || meta.Filename != "photo.png" {
+		t.Fatalf("got %q %+v %v, want the cached entry", data, meta, exists)
+	}
+	clock.time = clock.time.Add(time.Second)
+	if _, _, exists := cache.Get("key"); exists {
+		t.Error("entry outlived its ttl")
+	}
+}
+
+func TestMemoryCacheExpiresByCreated(t *testing.T) {
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	disk := fileCache{dir: t.TempDir(), ttl: time.Minute, now: clock.now}
+	if err := disk.Set("key", []byte("image"), cacheMeta{Created: clock.time, TTL: 60}); err != nil {
+		t.Fatal(err)
+	}
+	memory, err := newMemoryCache(10, 0, time.Minute, clock.now, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry is first read into memory shortly before it expires on disk.
+	clock.time = clock.time.Add(50 * time.Second)
+	if _, _, exists := memory.Get("key"); !exists {
+		t.Fatal("entry missing before its ttl")
+	}
+	clock.time = clock.time.Add(11 * time.Second)
+	if _, _, exists := memory.Get("key"); exists {
+		t.Error("memory kept the entry past the ttl it was rendered with")
+	}
+}
+
+func TestServerStoresRendersInTheCacheBackend(t *testing.T) {
+	s := newTestServer(t, nil)
+	cache := newFakeCache()
+	s.cache = cache
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	decodeBody(t, get(s, "/images/grayscale/photo.png"))
+	if len(cache.entries) != 1 {
+		t.Fatalf("got %d cached entries, want 1", len(cache.entries))
+	}
+	var key string
+	for k := range cache.entries {
+		key = k
+	}
+	meta := cache.entries[key].meta
+	if meta.Filename != "photo.png" || meta.Operations != "grayscale" || meta.ContentType != "image/png" {
+		t.Errorf("got meta %+v", meta)
+	}
+
+	// the stored content type is served, not one sniffed from the data.
+	cache.entries[key] = memoryEntry{data: cache.entries[key].data, meta: cacheMeta{ContentType: "image/webp"}}
+	rec := get(s, "/images/grayscale/photo.png")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("got status %d and Content-Type %q, want the cached image/webp", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	if err := s.cache.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if info := get(s, "/info/grayscale/photo.png"); !strings.Contains(info.Body.String(), `"cache_hit":false`) {
+		t.Errorf("deleted entry was still served: %s", info.Body)
+	}
+}
+
+func TestMemoryCacheDelete(t *testing.T) {
+	next := newFakeCache()
+	memory, err := newMemoryCache(10, 0, 0, time.Now, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Set("key", []byte("image"), cacheMeta{ContentType: "image/png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, exists := memory.Get("key"); exists {
+		t.Error("deleted entry is still cached")
+	}
+	if len(next.entries) != 0 {
+		t.Error("delete didn't reach the next backend")
+	}
+}
+
+func TestFileCacheDelete(t *testing.T) {
+	cache := fileCache{dir: t.TempDir(), now: time.Now}
+	if err := cache.Set("key", []byte("image"), cacheMeta{ContentType: "image/png"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, meta, _ := cache.Get("key"); meta.ContentType != "image/png" {
+		t.Errorf("got content type %q, want image/png", meta.ContentType)
+	}
+	if err := cache.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"key", "key" + metaSuffix} {
+		if _, err := os.Stat(filepath.Join(cache.dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is still on disk", name)
+		}
+	}
+	if err := cache.Delete("key"); err != nil {
+		t.Errorf("deleting a missing entry failed: %v", err)
+	}
+}
+
+func TestMemoryCacheInFrontOfAnotherBackend(t *testing.T) {
+	next := newFakeCache()
+	memory, err := newMemoryCache(2, 10, 0, time.Now, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Set("small", []byte("image"), cacheMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Set("large", []byte("a larger image"), cacheMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.entries) != 2 {
+		t.Fatalf("got %d entries in the next backend, want both written through", len(next.entries))
+	}
+
+	if _, _, exists := memory.Get("small"); !exists || next.gets != 0 {
+		t.Errorf("small image wasn't served from memory, the next backend was read %d times", next.gets)
+	}
+
+	// with the next backend emptied, only what memory holds is left.
+	clear(next.entries)
+	if _, _, exists := memory.Get("large"); exists {
+		t.Error("image over the entry size was held in memory")
+	}
+
+	// a miss in memory is read from the next backend and kept.
+	next.entries["disk"] = memoryEntry{data: []byte("image")}
+	if _, _, exists := memory.Get("disk"); !exists {
+		t.Fatal("miss wasn't read from the next backend")
+	}
+	delete(next.entries, "disk")
+	if _, _, exists := memory.Get("disk"); !exists {
+		t.Error("image read from the next backend wasn't kept in memory")
+	}
+
+	// memory holds two entries, a third pushes out the least recently used.
+	if err := memory.Set("third", []byte("image"), cacheMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	clear(next.entries)
+	for key, want := range map[string]bool{"small": false, "disk": true, "third": true} {
+		if _, _, exists := memory.Get(key); exists != want {
+			t.Errorf("%s held in memory %v, want %v", key, exists, want)
+		}
+	}
+}
+
+func TestFileCacheFailedSidecarLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	cache := fileCache{dir: dir, now: time.Now}
+	// a directory in the sidecar's place makes writing it fail
+	if err := os.Mkdir(filepath.Join(dir, "key"+metaSuffix), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("key", []byte("image"), cacheMeta{Filename: "photo.png"}); err == nil {
+		t.Fatal("expected an error writing the sidecar")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "key")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("image was left behind: %v", err)
+	}
+}
+
+func TestGenerateCacheKey(t *testing.T) {
+	tests := []struct {
+		filename, version, operations string
+		out                           output
+		want                          string
+	}{
+		{"photos/gorilla.jpeg", "1700000000000000000-12345", "resize=200x0,grayscale", output{format: "webp", quality: 80}, "c03b5dca0aae4667052dd6585beaacf2d15af99e8c510abdaad8a815a5eb5bde"},
+		{"gorilla.jpeg", "", "resize=200", output{format: "jpeg", keepMetadata: true}, "59cf923ef3b3c5dd59ba08414dd8d70bf15a893a5712d14f24e37c1b740485f4"},
+	}
+	for _, test := range tests {
+		if got := generateCacheKey(test.filename, test.version, test.operations, test.out); got != test.want {
+			t.Errorf("generateCacheKey(%q, %q, %q, %+v) = %s, want %s", test.filename, test.version, test.operations, test.out, got, test.want)
+		}
+	}
+
+	// the separators keep fields from running into each other.
+	if generateCacheKey("a", "", "bc", output{format: "png"}) == generateCacheKey("ab", "", "c", output{format: "png"}) {
+		t.Error("different fields gave the same key")
+	}
+}
+
+func TestDefaultQualityChangeRerenders(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.DefaultQuality = 90 })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 100))
+
+	high := get(s, "/images/format=jpeg/photo.png")
+	s.cfg.DefaultQuality = 20
+	if info := get(s, "/info/format=jpeg/photo.png"); !strings.Contains(info.Body.String(), `"cache_hit":false`) {
+		t.Errorf("changing defaultQuality served the cached image: %s", info.Body)
+	}
+	if low := get(s, "/images/format=jpeg/photo.png"); low.Body.Len() >= high.Body.Len() {
+		t.Errorf("defaultQuality 20 gave %d bytes, 90 gave %d", low.Body.Len(), high.Body.Len())
+	}
+}
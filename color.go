@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"image"
+	"net/http"
+	"time"
+)
+
+type dominantColor struct {
+	Hex string   `json:"hex"`
+	RGB [3]uint8 `json:"rgb"`
+}
+
+type cachedColor struct {
+	modTime time.Time
+	color   dominantColor
+}
+
+func (s *server) dominantColorHandler(c *gin.Context) {
+	filename := c.Param("filename")[1:]
+
+	// remote images have no modification time, so only their download is cached
+	_, modified := s.sourceVersion(c.Request.Context(), filename)
+	if cached, exists := s.colors.Load(filename); exists && !modified.IsZero() && cached.(cachedColor).modTime.Equal(modified) {
+		c.Set("cache_hit", true)
+		c.JSON(http.StatusOK, cached.(cachedColor).color)
+		return
+	}
+	if !s.limiter.allow(c) {
+		return
+	}
+
+	data, err := s.readSource(c.Request.Context(), filename)
+	if err != nil {
+		sourceError(filename, err).abort(c)
+		return
+	}
+	img, srcFormat, err := s.decodeImage(data, false)
+	if err != nil {
+		decodeError(err).abort(c)
+		return
+	}
+	if !s.cfg.allowsType("image/" + srcFormat) {
+		abort(c, http.StatusUnsupportedMediaType, "Image type not allowed", nil)
+		return
+	}
+
+	result := findDominantColor(img)
+	if !modified.IsZero() {
+		s.colors.Store(filename, cachedColor{modTime: modified, color: result})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// findDominantColor buckets the pixels of a downsampled copy of img by their
+// top four bits per channel and returns the average color of the fullest bucket.
+// Mostly transparent pixels are ignored unless the whole image is transparent.
+func findDominantColor(img image.Image) dominantColor {
+	small := imaging.Fit(img, 100, 100, imaging.Box)
+	type bucket struct{ count, r, g, b int }
+	buckets := make(map[int]*bucket)
+	add := func(skipTransparent bool) {
+		for i := 0; i < len(small.Pix); i += 4 {
+			r, g, b, a := small.Pix[i], small.Pix[i+1], small.Pix[i+2], small.Pix[i+3]
+			if skipTransparent && a < 128 {
+				continue
+			}
+			key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			if buckets[key] == nil {
+				buckets[key] = &bucket{}
+			}
+			buckets[key].count++
+			buckets[key].r += int(r)
+			buckets[key].g += int(g)
+			buckets[key].b += int(b)
+		}
+	}
+	if add(true); len(buckets) == 0 {
+		add(false)
+	}
+
+	bestKey := -1
+	for key, candidate := range buckets {
+		// ties go to the lowest key so the result doesn't depend on map order
+		if bestKey < 0 || candidate.count > buckets[bestKey].count || (candidate.count == buckets[bestKey].count && key < bestKey) {
+			bestKey = key
+		}
+	}
+	best := buckets[bestKey]
+	rgb := [3]uint8{uint8(best.r / best.count), uint8(best.g / best.count), uint8(best.b / best.count)}
+	return dominantColor{Hex: fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]), RGB: rgb}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFindDominantColor(t *testing.T) {
+	// 60% of the pixels are a red that fills a single bucket, the rest a blue.
+	img := imaging.Paste(imaging.New(100, 100, color.NRGBA{200, 30, 30, 255}), imaging.New(40, 100, color.NRGBA{20, 40, 220, 255}), image.Pt(60, 0))
+	if got := findDominantColor(img); got.Hex != "#c81e1e" {
+		t.Errorf("got %+v, want #c81e1e", got)
+	}
+
+	// transparent pixels don't count, however many there are.
+	img = imaging.Paste(imaging.New(100, 100, color.NRGBA{20, 40, 220, 0}), imaging.New(20, 20, color.NRGBA{200, 30, 30, 255}), image.Pt(0, 0))
+	if got := findDominantColor(img); got.Hex != "#c81e1e" {
+		t.Errorf("got %+v, want the opaque #c81e1e", got)
+	}
+}
+
+func TestDominantColorHandler(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "red.png", imaging.New(20, 20, color.NRGBA{200, 30, 30, 255}))
+
+	rec := get(s, "/color/red.png")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"hex":"#c81e1e"`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDominantColorErrorsMatchImages(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.MaxSourceSizeMB = 1 })
+	writeFile(t, s.cfg.ImageDir, "large.png", make([]byte, 2<<20))
+
+	for _, name := range []string{"large.png", "missing.png"} {
+		images, dominant := get(s, "/images/grayscale/"+name), get(s, "/color/"+name)
+		if images.Code == http.StatusOK || dominant.Code != images.Code {
+			t.Errorf("%s got status %d from /color and %d from /images", name, dominant.Code, images.Code)
+		}
+	}
+}
+
+func TestDominantColorOfRemoteImage(t *testing.T) {
+	var hits atomic.Int32
+	origin := imageServer(t, &hits)
+	s := newTestServer(t, func(cfg *config) { cfg.RemoteHosts = []string{"localhost"} })
+
+	if rec := get(s, "/color/"+remoteFilename(origin.URL+"/photo.png")); rec.Code != http.StatusOK {
+		t.Errorf("allowed host got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/color/"+url.PathEscape(origin.URL+"/photo.png")); rec.Code != http.StatusForbidden {
+		t.Errorf("host not on the list got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var defaultConfigFiles = []string{"config.yaml", "config.yml", "config.json"}
+
+type config struct {
+	Port                      int      `json:"port" yaml:"port"`
+	ImageDir                  string   `json:"imageDir" yaml:"imageDir"`
+	ImageDirs                 []string `json:"imageDirs" yaml:"imageDirs"`
+	CacheDir                  string   `json:"cacheDir" yaml:"cacheDir"`
+	MaxImageWidth             int      `json:"maxImageWidth" yaml:"maxImageWidth"`
+	MaxImageHeight            int      `json:"maxImageHeight" yaml:"maxImageHeight"`
+	MaxDimension              int      `json:"maxDimension" yaml:"maxDimension"`
+	MaxOperations             int      `json:"maxOperations" yaml:"maxOperations"`
+	MaxMegapixels             float64  `json:"maxMegapixels" yaml:"maxMegapixels"`
+	MaxSourceSizeMB           int      `json:"maxSourceSizeMb" yaml:"maxSourceSizeMb"`
+	MaxSourceMegapixels       float64  `json:"maxSourceMegapixels" yaml:"maxSourceMegapixels"`
+	DefaultQuality            int      `json:"defaultQuality" yaml:"defaultQuality"`
+	StripExif                 bool     `json:"stripExif" yaml:"stripExif"`
+	TextFont                  string   `json:"textFont" yaml:"textFont"`
+	TextFallbackFont          string   `json:"textFallbackFont" yaml:"textFallbackFont"`
+	TextSize                  int      `json:"textSize" yaml:"textSize"`
+	AllowedTypes              []string `json:"allowedTypes" yaml:"allowedTypes"`
+	AllowedOperations         []string `json:"allowedOperations" yaml:"allowedOperations"`
+	SignKey                   string   `json:"signKey" yaml:"signKey"`
+	AdminToken                string   `json:"adminToken" yaml:"adminToken"`
+	AllowAnonymousNocache     bool     `json:"allowAnonymousNocache" yaml:"allowAnonymousNocache"`
+	RateLimitRPS              float64  `json:"rateLimitRps" yaml:"rateLimitRps"`
+	TrustedProxies            []string `json:"trustedProxies" yaml:"trustedProxies"`
+	RateLimitBurst            int      `json:"rateLimitBurst" yaml:"rateLimitBurst"`
+	CacheMaxAge               int      `json:"cacheMaxAge" yaml:"cacheMaxAge"`
+	CacheStaleWhileRevalidate int      `json:"cacheStaleWhileRevalidate" yaml:"cacheStaleWhileRevalidate"`
+	CacheImmutable            bool     `json:"cacheImmutable" yaml:"cacheImmutable"`
+	RedisURL                  string   `json:"redisUrl" yaml:"redisUrl"`
+	CacheTTL                  int      `json:"cacheTtl" yaml:"cacheTtl"`
+	MemoryCacheSize           int      `json:"memoryCacheSize" yaml:"memoryCacheSize"`
+	MemoryCacheMaxEntryKB     int      `json:"memoryCacheMaxEntryKb" yaml:"memoryCacheMaxEntryKb"`
+	CacheMaxSizeMB            int      `json:"cacheMaxSizeMb" yaml:"cacheMaxSizeMb"`
+	CacheCleanup              int      `json:"cacheCleanupInterval" yaml:"cacheCleanupInterval"`
+	RemoteHosts               []string `json:"remoteHosts" yaml:"remoteHosts"`
+	RemoteTimeout             int      `json:"remoteTimeout" yaml:"remoteTimeout"`
+	S3Bucket                  string   `json:"s3Bucket" yaml:"s3Bucket"`
+	S3Region                  string   `json:"s3Region" yaml:"s3Region"`
+	S3Prefix                  string   `json:"s3Prefix" yaml:"s3Prefix"`
+}
+
+func defaultConfig() config {
+	return config{
+		Port:                80,
+		ImageDir:            "images",
+		CacheDir:            ".cache",
+		MaxImageWidth:       4096,
+		MaxImageHeight:      4096,
+		MaxDimension:        10000,
+		MaxMegapixels:       50,
+		MaxOperations:       20,
+		MaxSourceMegapixels: 100,
+		TextSize:            24,
+		CacheMaxAge:         86400,
+		CacheCleanup:        10,
+		RemoteTimeout:       10,
+	}
+}
+
+// configFromArgs loads the config file named by -config and applies the command line flags
+// over it, a flag wins over the environment, which wins over the file. It also returns the
+// path given to -sign.
+func configFromArgs(args []string) (config, string, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configPath := flags.String("config", "", "path to a yaml or json config file")
+	sign := flags.String("sign", "", "print a signed url for the given path, eg /images/resize=200x0/gorilla.jpeg, and exit")
+	port := flags.Int("port", 0, "port to listen on, overrides PORT and the config file")
+	imageDir := flags.String("image-dir", "", "directory source images are read from, overrides IMAGE_DIR and the config file")
+	cacheDir := flags.String("cache-dir", "", "directory transformed images are cached in, overrides CACHE_DIR and the config file")
+	if err := flags.Parse(args); err != nil {
+		return config{}, "", err
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return cfg, "", err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "image-dir":
+			cfg.ImageDir = *imageDir
+		case "cache-dir":
+			cfg.CacheDir = *cacheDir
+		}
+	})
+	return cfg, *sign, nil
+}
+
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+
+	if path == "" {
+		for _, candidate := range defaultConfigFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path != "" {
+		err := readConfigFile(path, &cfg)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Config file not found, using defaults", "path", path)
+		} else if err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.DefaultQuality < 0 || cfg.DefaultQuality > 100 {
+		return cfg, fmt.Errorf("defaultQuality must be between 1 and 100")
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return cfg, fmt.Errorf("trustedProxies: %q is not an ip address or cidr range", proxy)
+		}
+	}
+	if cfg.TextSize < 1 || cfg.TextSize > 500 {
+		return cfg, fmt.Errorf("textSize must be between 1 and 500")
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".json":
+		err = json.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config file %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func applyEnv(cfg *config) error {
+	var errs []error
+	envInt := func(key string, target *int) {
+		if value, exists := os.LookupEnv(key); exists && value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %v", key, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	envFloat := func(key string, target *float64) {
+		if value, exists := os.LookupEnv(key); exists && value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %v", key, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	envBool := func(key string, target *bool) {
+		if value, exists := os.LookupEnv(key); exists && value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %v", key, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	envString := func(key string, target *string) {
+		if value, exists := os.LookupEnv(key); exists && value != "" {
+			*target = value
+		}
+	}
+
+	envInt("PORT", &cfg.Port)
+	envString("IMAGE_DIR", &cfg.ImageDir)
+	if value, exists := os.LookupEnv("IMAGE_DIRS"); exists && value != "" {
+		cfg.ImageDirs = strings.Split(value, ",")
+	}
+	envString("CACHE_DIR", &cfg.CacheDir)
+	envInt("MAX_IMAGE_WIDTH", &cfg.MaxImageWidth)
+	envInt("MAX_IMAGE_HEIGHT", &cfg.MaxImageHeight)
+	envInt("MAX_OUTPUT_WIDTH", &cfg.MaxImageWidth)
+	envInt("MAX_OUTPUT_HEIGHT", &cfg.MaxImageHeight)
+	envInt("MAX_DIMENSION", &cfg.MaxDimension)
+	envInt("MAX_OPERATIONS", &cfg.MaxOperations)
+	envFloat("MAX_MEGAPIXELS", &cfg.MaxMegapixels)
+	envInt("MAX_SOURCE_SIZE_MB", &cfg.MaxSourceSizeMB)
+	envFloat("MAX_SOURCE_MEGAPIXELS", &cfg.MaxSourceMegapixels)
+	envInt("DEFAULT_QUALITY", &cfg.DefaultQuality)
+	envBool("STRIP_EXIF", &cfg.StripExif)
+	envString("TEXT_FONT", &cfg.TextFont)
+	envString("TEXT_FALLBACK_FONT", &cfg.TextFallbackFont)
+	envInt("TEXT_SIZE", &cfg.TextSize)
+	if value, exists := os.LookupEnv("ALLOWED_TYPES"); exists && value != "" {
+		cfg.AllowedTypes = strings.Split(value, ",")
+	}
+	if value, exists := os.LookupEnv("ALLOWED_OPERATIONS"); exists && value != "" {
+		cfg.AllowedOperations = strings.Split(value, ",")
+	}
+	envString("SIGN_KEY", &cfg.SignKey)
+	envString("ADMIN_TOKEN", &cfg.AdminToken)
+	envBool("ALLOW_ANONYMOUS_NOCACHE", &cfg.AllowAnonymousNocache)
+	envFloat("RATE_LIMIT_RPS", &cfg.RateLimitRPS)
+	envInt("RATE_LIMIT_BURST", &cfg.RateLimitBurst)
+	if value, exists := os.LookupEnv("TRUSTED_PROXIES"); exists && value != "" {
+		cfg.TrustedProxies = strings.Split(value, ",")
+	}
+	envInt("CACHE_MAX_AGE", &cfg.CacheMaxAge)
+	envInt("CACHE_STALE_WHILE_REVALIDATE", &cfg.CacheStaleWhileRevalidate)
+	envBool("CACHE_IMMUTABLE", &cfg.CacheImmutable)
+	envString("REDIS_URL", &cfg.RedisURL)
+	envInt("CACHE_TTL", &cfg.CacheTTL)
+	envInt("MEMORY_CACHE_SIZE", &cfg.MemoryCacheSize)
+	envInt("MEMORY_CACHE_MAX_ENTRY_KB", &cfg.MemoryCacheMaxEntryKB)
+	envInt("CACHE_MAX_SIZE_MB", &cfg.CacheMaxSizeMB)
+	envInt("CACHE_CLEANUP_INTERVAL", &cfg.CacheCleanup)
+	if value, exists := os.LookupEnv("REMOTE_HOSTS"); exists && value != "" {
+		cfg.RemoteHosts = strings.Split(value, ",")
+	}
+	envInt("REMOTE_TIMEOUT", &cfg.RemoteTimeout)
+	envString("S3_BUCKET", &cfg.S3Bucket)
+	envString("S3_REGION", &cfg.S3Region)
+	envString("S3_PREFIX", &cfg.S3Prefix)
+	return errors.Join(errs...)
+}
+
+// imageDirs returns the directories searched for source images in order.
+func (cfg config) imageDirs() []string {
+	if len(cfg.ImageDirs) > 0 {
+		return cfg.ImageDirs
+	}
+	return []string{cfg.ImageDir}
+}
+
+func (cfg config) allowsType(mimeType string) bool {
+	if len(cfg.AllowedTypes) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedTypes {
+		if strings.EqualFold(strings.TrimSpace(allowed), mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg config) allowsOperation(name string) bool {
+	if len(cfg.AllowedOperations) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedOperations {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg config) allowsRemoteHost(host string) bool {
+	for _, allowed := range cfg.RemoteHosts {
+		if strings.EqualFold(strings.TrimSpace(allowed), host) {
+			return true
+		}
+	}
+	return false
+}
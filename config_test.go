@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigMergesDefaults(t *testing.T) {
+	tests := map[string]string{
+		"config.yaml": "port: 9000\nimageDir: photos\ndefaultQuality: 80\nallowedOperations:\n  - resize\n  - fit\n",
+		"config.json": `{"port": 9000, "imageDir": "photos", "defaultQuality": 80, "allowedOperations": ["resize", "fit"]}`,
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, name, contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := defaultConfig()
+			want.Port = 9000
+			want.ImageDir = "photos"
+			want.DefaultQuality = 80
+			want.AllowedOperations = []string{"resize", "fit"}
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFileUsesDefaults(t *testing.T) {
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("got %+v, want the defaults", cfg)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := map[string]string{
+		"config.yaml": "port: [not a number\n",
+		"config.json": `{"port": "80"}`,
+		"config.toml": "port = 80\n",
+		"range.yaml":  "defaultQuality: 101\n",
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, name, contents)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, "config.yaml", "port: 1000\nimageDir: from-file\n")
+	empty := writeConfig(t, "empty.yaml", "")
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want int
+	}{
+		{"default", "", []string{"-config", empty}, 80},
+		{"file", "", []string{"-config", file}, 1000},
+		{"env", "2000", []string{"-config", file}, 2000},
+		{"flag", "2000", []string{"-config", file, "-port", "3000"}, 3000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("PORT", test.env)
+			cfg, _, err := configFromArgs(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != test.want {
+				t.Errorf("got port %d, want %d", cfg.Port, test.want)
+			}
+		})
+	}
+
+	t.Setenv("IMAGE_DIR", "from-env")
+	cfg, sign, err := configFromArgs([]string{"-config", file, "-cache-dir", "from-flag", "-sign", "/images/grayscale/a.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ImageDir != "from-env" || cfg.CacheDir != "from-flag" || sign != "/images/grayscale/a.png" {
+		t.Errorf("got image dir %q, cache dir %q and sign %q", cfg.ImageDir, cfg.CacheDir, sign)
+	}
+}
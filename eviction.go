@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheFile struct {
+	path     string
+	size     int64
+	accessed time.Time
+}
+
+// cacheIndex tracks the files in the cache directory in least recently used order and
+// removes the oldest once they take up more than maxBytes. A cached image and its metadata
+// sidecar count as one entry. Access times are kept in the files' modification time so the
+// order survives a restart. A nil index tracks nothing.
+type cacheIndex struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	total    int64
+	order    *list.List // most recently used at the front
+	entries  map[string]*list.Element
+}
+
+func newCacheIndex(dir string, maxBytes int64) (*cacheIndex, error) {
+	ix := &cacheIndex{dir: dir, maxBytes: maxBytes}
+	return ix, ix.rescan()
+}
+
+// rescanLoop rebuilds the index from disk every interval until ctx is done, picking up files
+// changed by anything else.
+func (ix *cacheIndex) rescanLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ix.rescan(); err != nil {
+				slog.Error("Failed to scan cache directory", "error", err)
+			}
+		}
+	}
+}
+
+func (ix *cacheIndex) rescan() error {
+	var files []cacheFile
+	sidecars := make(map[string]int64)
+	err := filepath.WalkDir(ix.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if image, isMeta := strings.CutSuffix(path, metaSuffix); isMeta {
+			sidecars[image] = info.Size()
+			return nil
+		}
+		files = append(files, cacheFile{path: path, size: info.Size(), accessed: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(files, func(a, b cacheFile) int { return b.accessed.Compare(a.accessed) })
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.order = list.New()
+	ix.entries = make(map[string]*list.Element, len(files))
+	ix.total = 0
+	for _, file := range files {
+		file.size += sidecars[file.path]
+		ix.entries[file.path] = ix.order.PushBack(&file)
+		ix.total += file.size
+	}
+	ix.evict()
+	return nil
+}
+
+// used marks a cached file as just served.
+func (ix *cacheIndex) used(path string) {
+	if ix == nil {
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if element, exists := ix.entries[path]; exists {
+		element.Value.(*cacheFile).accessed = now
+		ix.order.MoveToFront(element)
+	}
+}
+
+// added records a file written to the cache, evicting others when the budget is exceeded.
+func (ix *cacheIndex) added(path string, size int64) {
+	if ix == nil {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if element, exists := ix.entries[path]; exists {
+		file := element.Value.(*cacheFile)
+		ix.total += size - file.size
+		file.size, file.accessed = size, time.Now()
+		ix.order.MoveToFront(element)
+	} else {
+		ix.entries[path] = ix.order.PushFront(&cacheFile{path: path, size: size, accessed: time.Now()})
+		ix.total += size
+	}
+	ix.evict()
+}
+
+// removed forgets a file deleted from the cache by other means.
+func (ix *cacheIndex) removed(path string) {
+	if ix == nil {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if element, exists := ix.entries[path]; exists {
+		ix.total -= element.Value.(*cacheFile).size
+		ix.order.Remove(element)
+		delete(ix.entries, path)
+	}
+}
+
+// evict must be called with mu held.
+func (ix *cacheIndex) evict() {
+	for ix.total > ix.maxBytes && ix.order.Len() > 0 {
+		file := ix.order.Remove(ix.order.Back()).(*cacheFile)
+		delete(ix.entries, file.path)
+		ix.total -= file.size
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to evict cached image", "path", file.path, "error", err)
+			continue
+		}
+		os.Remove(file.path + metaSuffix)
+		slog.Info("Evicted cached image", "path", file.path, "size", file.size, "last_access", file.accessed)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCacheEvictsTheLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte{1}, 1000)
+	meta, _ := json.Marshal(cacheMeta{})
+	entry := int64(len(data) + len(meta))
+
+	index, err := newCacheIndex(dir, 2*entry+entry/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := fileCache{dir: dir, index: index, now: time.Now}
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Set(key, data, cacheMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, exists := cache.Get("a"); !exists {
+		t.Fatal("a is missing before the budget was reached")
+	}
+	if err := cache.Set("c", data, cacheMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, exists := cache.Get(key); exists != want {
+			t.Errorf("%s cached %v, want %v", key, exists, want)
+		}
+	}
+}
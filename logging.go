@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"time"
+)
+
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	attrs := []any{
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", c.Writer.Status()),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.Bool("cache_hit", c.GetBool("cache_hit")),
+	}
+	if err := c.Errors.Last(); err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	level := slog.LevelInfo
+	if c.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(c.Request.Context(), level, "request", attrs...)
+}
+
+func abort(c *gin.Context, status int, message string, err error) {
+	if err == nil {
+		err = errors.New(message)
+	}
+	_ = c.Error(err)
+	c.Header("Cache-Control", "no-store")
+	c.String(status, message)
+}
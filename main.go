@@ -1,102 +1,590 @@
 package main
 
 import (
-	"crypto/md5"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/sync/singleflight"
 	"image"
-	"log"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	cacheDir        = ".cache"
-	imageDir        = "images"
-	transformations = map[string]func(image.Image, string) (image.Image, error){
-		"blur":       imageEffect(imaging.Blur),
-		"sharpen":    imageEffect(imaging.Sharpen),
+	filters = map[string]imaging.ResampleFilter{
+		"lanczos":  imaging.Lanczos,
+		"nearest":  imaging.NearestNeighbor,
+		"box":      imaging.Box,
+		"linear":   imaging.Linear,
+		"hermite":  imaging.Hermite,
+		"mitchell": imaging.MitchellNetravali,
+		"catrom":   imaging.CatmullRom,
+	}
+	outputOptions = map[string]func(*output, string) error{
+		"format":          outputFormat,
+		"quality":         outputQuality,
+		"speed":           outputSpeed,
+		"png_compression": outputPNGCompression,
+		"progressive":     outputProgressive,
+		"keep_metadata":   outputKeepMetadata,
+		"auto_orient":     outputAutoOrient,
+		"dpr":             outputDPR,
+		"no_upscale":      outputNoUpscale,
+	}
+	formats = map[string]string{
+		"jpeg": ".jpg",
+		"png":  ".png",
+		"gif":  ".gif",
+		"tiff": ".tif",
+		"bmp":  ".bmp",
+		"webp": ".webp",
+		"avif": ".avif",
+	}
+	negotiableFormats   = []string{"avif", "webp"}
+	alphaOperations     = map[string]bool{"round": true, "circle": true}
+	dimensionOperations = map[string]bool{"resize": true, "fit": true, "fill": true, "crop": true, "smartcrop": true, "pad": true}
+	upscaleOperations   = map[string]bool{"resize": true, "fill": true}
+	namedColors         = map[string]color.NRGBA{
+		"transparent": {},
+		"black":       {A: 255},
+		"white":       {R: 255, G: 255, B: 255, A: 255},
+		"gray":        {R: 128, G: 128, B: 128, A: 255},
+		"red":         {R: 255, A: 255},
+		"green":       {G: 128, A: 255},
+		"blue":        {B: 255, A: 255},
+		"yellow":      {R: 255, G: 255, A: 255},
+	}
+)
+
+type renderedImage struct {
+	data     []byte
+	format   string
+	width    int
+	height   int
+	cacheHit bool
+}
+
+type output struct {
+	format       string
+	quality      int
+	speed        int
+	compression  png.CompressionLevel
+	progressive  bool
+	keepMetadata bool
+	autoOrient   bool
+	metadata     []byte
+	negotiated   bool
+	alpha        string
+	flattened    bool
+	dpr          float64
+	noUpscale    bool
+}
+
+func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	cfg, sign, err := configFromArgs(os.Args[1:])
+	if err != nil {
+		slog.Error("Failed to load config", "error", err)
+		os.Exit(1)
+	}
+
+	if sign != "" {
+		if cfg.SignKey == "" {
+			slog.Error("No sign key configured")
+			os.Exit(1)
+		}
+		fmt.Println(signURL(cfg.SignKey, sign))
+		return
+	}
+
+	if err := serve(cfg); err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// server holds the configuration and the backends shared by every request.
+type server struct {
+	cfg     config
+	source  SourceBackend
+	cache   CacheBackend
+	index   *cacheIndex
+	limiter *rateLimiter
+	renders singleflight.Group
+	font    func() (*opentype.Font, error)
+
+	colors     sync.Map
+	blurHashes sync.Map
+
+	transformations map[string]func(image.Image, string) (image.Image, error)
+	// resampleTransformations resize the image with the filter chosen earlier in the chain.
+	resampleTransformations map[string]func(image.Image, string, imaging.ResampleFilter) (image.Image, error)
+	// sourceTransformations read another source image within the request's context.
+	sourceTransformations map[string]func(context.Context, image.Image, string) (image.Image, error)
+}
+
+func newServer(cfg config) (*server, error) {
+	s := &server{cfg: cfg}
+	var err error
+	if s.source, err = newSourceBackend(cfg); err != nil {
+		return nil, fmt.Errorf("setting up image source: %w", err)
+	}
+	if err := os.MkdirAll(cfg.CacheDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	if cfg.CacheMaxSizeMB > 0 {
+		if s.index, err = newCacheIndex(cfg.CacheDir, int64(cfg.CacheMaxSizeMB)<<20); err != nil {
+			return nil, fmt.Errorf("indexing cache directory: %w", err)
+		}
+	}
+	if s.cache, err = newCacheBackend(cfg, s.index); err != nil {
+		return nil, fmt.Errorf("setting up image cache: %w", err)
+	}
+	if cfg.RateLimitRPS > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, time.Now)
+	}
+	s.font = sync.OnceValues(func() (*opentype.Font, error) {
+		return loadFont(cfg.TextFont, cfg.TextFallbackFont)
+	})
+
+	s.transformations = map[string]func(image.Image, string) (image.Image, error){
+		"blur":       imageBlur,
+		"background": imageBackground,
+		"border":     s.imageBorder,
+		"sharpen":    imageSharpen,
+		"unsharp":    imageUnsharp,
+		"vignette":   imageVignette,
 		"gamma":      imageEffect(imaging.AdjustGamma),
 		"contrast":   imageEffect(imaging.AdjustContrast),
 		"brightness": imageEffect(imaging.AdjustBrightness),
 		"saturation": imageEffect(imaging.AdjustSaturation),
 		"hue":        imageEffect(imaging.AdjustHue),
-		"resize":     imageResize,
-		"fit":        imageFit,
-		"fill":       imageFill,
-		"crop":       imageCrop,
+		"crop":       s.imageCrop,
+		"rotate":     s.imageRotate,
+		"rotate90":   imageRotate90,
+		"rotate180":  imageRotate180,
+		"rotate270":  imageRotate270,
 		"grayscale":  imageGrayscale,
 		"invert":     imageInvert,
+		"normalize":  imageNormalize,
+		"fliph":      imageFlipH,
+		"flipv":      imageFlipV,
+		"sepia":      imageSepia,
+		"duotone":    imageDuotone,
+		"tint":       imageTint,
+		"pixelate":   imagePixelate,
+		"noise":      imageNoise,
+		"trim":       imageTrim,
+		"round":      imageRound,
+		"circle":     imageCircle,
+		"text":       s.imageText,
 	}
-)
-
-func init() {
-	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
-		log.Fatalf("Failed to create cache directory: %v", err)
+	s.resampleTransformations = map[string]func(image.Image, string, imaging.ResampleFilter) (image.Image, error){
+		"resize":    s.imageResize,
+		"scale":     s.imageScale,
+		"fit":       s.imageFit,
+		"pad":       s.imagePad,
+		"fill":      s.imageFill,
+		"smartcrop": s.imageSmartcrop,
+	}
+	s.sourceTransformations = map[string]func(context.Context, image.Image, string) (image.Image, error){
+		"watermark": s.imageWatermark,
 	}
-	log.Println("Cache directory:", cacheDir)
+	return s, nil
 }
 
-func main() {
-	serve()
+// serve listens on the configured port until the server fails.
+func serve(cfg config) error {
+	s, err := newServer(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Cache directory", "path", cfg.CacheDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if s.limiter != nil {
+		go s.limiter.evictLoop(ctx, time.Minute)
+	}
+	if s.index != nil && cfg.CacheCleanup > 0 {
+		go s.index.rescanLoop(ctx, time.Duration(cfg.CacheCleanup)*time.Minute)
+	}
+	return s.router().Run(fmt.Sprintf(":%d", cfg.Port))
 }
 
-func serve() {
-	r := gin.Default()
+func (s *server) router() *gin.Engine {
+	r := gin.New()
+	// X-Forwarded-For is only believed from trusted proxies, so clients can't pick their own ip
+	if err := r.SetTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies, trusting none", "error", err)
+		_ = r.SetTrustedProxies(nil)
+	}
+	r.Use(requestLogger, gin.Recovery(), metricsMiddleware)
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	r.GET("/healthz", func(c *gin.Context) {
+		payload := gin.H{"status": "ok", "cache_dir": s.cfg.CacheDir, "image_dir": s.cfg.ImageDir}
+		if len(s.cfg.ImageDirs) > 0 {
+			payload["image_dirs"] = s.cfg.ImageDirs
+		}
+		if err := s.checkDirectories(); err != nil {
+			payload["status"] = "unavailable"
+			payload["error"] = err.Error()
+			c.JSON(http.StatusServiceUnavailable, payload)
+			return
+		}
+		c.JSON(http.StatusOK, payload)
+	})
+
+	if s.cfg.AdminToken != "" {
+		admin := r.Group("/", s.adminMiddleware)
+		admin.DELETE("/cache", s.clearCacheHandler)
+		admin.DELETE("/cache/*filename", s.invalidateCacheHandler)
+	}
+
+	protected := r.Group("/", s.signatureMiddleware, filenameMiddleware)
 
-	r.GET("/images/:operations/*filename", func(c *gin.Context) {
-		operations := c.Param("operations")
+	protected.GET("/color/*filename", s.dominantColorHandler)
+	protected.GET("/blurhash/*filename", s.blurHashHandler)
+
+	protected.GET("/images/:operations/*filename", func(c *gin.Context) {
+		operations := operationsParam(c)
 		filename := c.Param("filename")[1:]
 
-		cacheKey := generateCacheKey(filename, operations)
-		imageCache := filepath.Join(cacheDir, cacheKey+".jpg")
-		imagePath := filepath.Join(imageDir, filename)
+		out, err := s.parseOutput(operations, c.GetHeader("Accept"))
+		if err != nil {
+			abort(c, http.StatusBadRequest, err.Error(), err)
+			return
+		}
 
-		if _, err := os.Stat(imageCache); err == nil {
-			c.File(imagePath)
+		version, modified := s.renderVersion(c.Request.Context(), filename, operations)
+		cacheKey := generateCacheKey(filename, version, operations, out)
+		if !s.bypassCache(c) && notModified(c, `"`+cacheKey+`"`, !modified.IsZero(), modified) {
+			s.setCacheHeaders(c, cacheKey, modified)
+			c.Status(http.StatusNotModified)
 			return
 		}
 
-		src, err := imaging.Open(imagePath)
-		if err != nil {
-			c.String(http.StatusNotFound, "Image not found")
+		rendered, ok := s.renderImage(c, filename, operations, cacheKey, out)
+		if !ok {
 			return
 		}
 
-		img, err := applyTransformations(src, operations)
+		s.setCacheHeaders(c, cacheKey, modified)
+		setSizeHeaders(c, rendered.width, rendered.height)
+		c.Header("Content-Type", "image/"+rendered.format)
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(rendered.data))
+	})
+
+	protected.GET("/info/:operations/*filename", func(c *gin.Context) {
+		operations := operationsParam(c)
+		filename := c.Param("filename")[1:]
+
+		out, err := s.parseOutput(operations, c.GetHeader("Accept"))
 		if err != nil {
-			c.String(http.StatusBadRequest, err.Error())
+			abort(c, http.StatusBadRequest, err.Error(), err)
 			return
 		}
 
-		if err := imaging.Save(img, imageCache); err != nil {
-			c.String(http.StatusInternalServerError, "Failed to save cached image")
+		version, _ := s.renderVersion(c.Request.Context(), filename, operations)
+		cacheKey := generateCacheKey(filename, version, operations, out)
+		rendered, ok := s.renderImage(c, filename, operations, cacheKey, out)
+		if !ok {
 			return
 		}
 
-		c.File(imageCache)
+		c.Header("Vary", "Accept")
+		c.JSON(http.StatusOK, gin.H{
+			"width":      rendered.width,
+			"height":     rendered.height,
+			"format":     rendered.format,
+			"size_bytes": len(rendered.data),
+			"cache_hit":  rendered.cacheHit,
+		})
 	})
 
-	log.Fatal(r.Run(":80"))
+	return r
 }
 
-func applyTransformations(img image.Image, operations string) (image.Image, error) {
+// renderImage returns the cached result of the operations, writing it first on a miss.
+// It responds with an error itself and returns false when the image can't be produced.
+func (s *server) renderImage(c *gin.Context, filename, operations, cacheKey string, out output) (renderedImage, bool) {
+	if !s.bypassCache(c) {
+		if data, meta, exists := s.cache.Get(cacheKey); exists {
+			cacheRequests.WithLabelValues("hit").Inc()
+			c.Set("cache_hit", true)
+			rendered := renderedImage{data: data, cacheHit: true}
+			rendered.width, rendered.height, rendered.format, _ = cachedImageConfig(data)
+			if format, found := strings.CutPrefix(meta.ContentType, "image/"); found {
+				rendered.format = format
+			}
+			return rendered, true
+		}
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+	if !s.limiter.allow(c) {
+		return renderedImage{}, false
+	}
+
+	// concurrent misses for the same key wait for a single render, which must
+	// outlive the request that started it.
+	ctx := context.WithoutCancel(c.Request.Context())
+	result, err, _ := s.renders.Do(cacheKey, func() (any, error) {
+		return s.generateImage(ctx, filename, operations, cacheKey, out)
+	})
+	if err != nil {
+		var renderErr *renderError
+		if errors.As(err, &renderErr) {
+			renderErr.abort(c)
+		} else {
+			abort(c, http.StatusInternalServerError, "Failed to render image", err)
+		}
+		return renderedImage{}, false
+	}
+	return result.(renderedImage), true
+}
+
+// renderError carries the response for an image that couldn't be produced.
+type renderError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *renderError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return e.message
+}
+
+func (e *renderError) abort(c *gin.Context) {
+	abort(c, e.status, e.message, e.err)
+}
+
+// sourceError maps a failure to read filename to its response, the same on every endpoint.
+func sourceError(filename string, err error) *renderError {
+	switch {
+	case errors.Is(err, errRemoteHostNotAllowed):
+		return &renderError{http.StatusForbidden, "Remote host not allowed", err}
+	case errors.Is(err, errSourceTooLarge):
+		return &renderError{http.StatusBadRequest, "Source image is too large", err}
+	case errors.Is(err, errInvalidFilename):
+		return &renderError{http.StatusBadRequest, "Invalid filename", err}
+	case isRemote(filename):
+		return &renderError{http.StatusBadGateway, "Failed to fetch remote image", err}
+	case errors.Is(err, os.ErrNotExist):
+		return &renderError{http.StatusNotFound, "Image not found", err}
+	default:
+		return &renderError{http.StatusBadGateway, "Failed to read image", err}
+	}
+}
+
+// decodeError maps a failure to decode a source image to its response.
+func decodeError(err error) *renderError {
+	if errors.Is(err, errSourceTooBig) {
+		return &renderError{http.StatusBadRequest, "Source image has too many pixels", err}
+	}
+	return &renderError{http.StatusUnsupportedMediaType, "Unsupported or corrupt image", err}
+}
+
+// generateImage decodes the source, applies the operations and stores the result in the cache.
+func (s *server) generateImage(ctx context.Context, filename, operations, cacheKey string, out output) (renderedImage, error) {
+	data, err := s.readSource(ctx, filename)
+	if err != nil {
+		return renderedImage{}, sourceError(filename, err)
+	}
+	src, srcFormat, err := s.decodeImage(data, out.autoOrient)
+	if err != nil {
+		return renderedImage{}, decodeError(err)
+	}
+	if !s.cfg.allowsType("image/" + srcFormat) {
+		return renderedImage{}, &renderError{http.StatusUnsupportedMediaType, "Image type not allowed", nil}
+	}
+	if out.format == "" {
+		out.format = sourceFormat(srcFormat)
+	}
+	if out.keepMetadata {
+		if out.metadata, err = readJPEGMetadata(bytes.NewReader(data)); err != nil {
+			return renderedImage{}, &renderError{http.StatusInternalServerError, "Failed to read image metadata", err}
+		}
+		if out.autoOrient {
+			resetOrientation(out.metadata)
+		}
+	}
+
+	img, err := s.applyTransformations(ctx, src, operations, out)
+	if err != nil {
+		return renderedImage{}, &renderError{http.StatusBadRequest, err.Error(), err}
+	}
+
+	bounds := img.Bounds()
+	if out.negotiated && out.format == "jpeg" && (out.alpha != "" || (hasAlpha(src) && !out.flattened)) {
+		out.format = "png"
+	}
+
+	encoded, err := outputImage(img, out)
+	if err != nil {
+		return renderedImage{}, &renderError{http.StatusInternalServerError, "Failed to encode image", err}
+	}
+	meta := cacheMeta{
+		Filename:    filename,
+		Operations:  operations,
+		ContentType: "image/" + out.format,
+		Created:     time.Now(),
+		TTL:         s.cfg.CacheTTL,
+	}
+	if err := s.cache.Set(cacheKey, encoded, meta); err != nil {
+		return renderedImage{}, &renderError{http.StatusInternalServerError, "Failed to save cached image", err}
+	}
+	return renderedImage{data: encoded, format: out.format, width: bounds.Dx(), height: bounds.Dy()}, nil
+}
+
+func (s *server) checkDirectories() error {
+	if _, local := s.source.(localSource); local {
+		for _, dir := range s.cfg.imageDirs() {
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("image directory %s is not accessible", dir)
+			}
+		}
+	}
+	file, err := os.CreateTemp(s.cfg.CacheDir, ".healthz-*")
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable")
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func parseOperation(op string) (string, string) {
+	parts := strings.SplitN(op, "=", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+// parseOutput reads the output options and checks the chain before anything is served, so a
+// cached or not modified response is never given for operations the server would refuse.
+func (s *server) parseOutput(operations, accept string) (output, error) {
+	out := output{format: negotiateFormat(accept), negotiated: true, autoOrient: true, dpr: 1, quality: s.cfg.DefaultQuality}
+	ops := strings.Split(operations, ",")
+	if s.cfg.MaxOperations > 0 && len(ops) > s.cfg.MaxOperations {
+		return out, fmt.Errorf("too many operations, at most %d are allowed", s.cfg.MaxOperations)
+	}
+	for _, op := range ops {
+		if op == "" {
+			// empty segments, such as from a trailing comma, do nothing
+			continue
+		}
+		opName, opParam := parseOperation(op)
+		if !s.cfg.allowsOperation(opName) {
+			return out, fmt.Errorf("operation %q is not allowed", opName)
+		}
+		if !s.knowsOperation(opName) {
+			return out, fmt.Errorf("unknown operation %q", opName)
+		}
+		if optionFunc, exists := outputOptions[opName]; exists {
+			if err := optionFunc(&out, opParam); err != nil {
+				return out, fmt.Errorf("error applying %s: %v", opName, err)
+			}
+		}
+		if alphaOperations[opName] {
+			out.alpha = opName
+		}
+		if background, err := parseColor(opParam); opName == "background" && err == nil && background.A == 255 {
+			out.alpha = ""
+			out.flattened = true
+		}
+	}
+	if out.keepMetadata && s.cfg.StripExif {
+		return out, fmt.Errorf("error applying keep_metadata: keeping metadata is disabled on this server")
+	}
+	if out.alpha != "" && out.format == "jpeg" && !out.negotiated {
+		return out, fmt.Errorf("%s needs an output format with transparency, jpeg has none", out.alpha)
+	}
+	return out, nil
+}
+
+// knowsOperation reports whether name is an operation or output option, the empty name does nothing.
+func (s *server) knowsOperation(name string) bool {
+	_, transforms := s.transformations[name]
+	_, resamples := s.resampleTransformations[name]
+	_, readsSource := s.sourceTransformations[name]
+	_, isOption := outputOptions[name]
+	return transforms || resamples || readsSource || isOption || name == "filter" || name == ""
+}
+
+// applyTransformations runs the operations in order, multiplying the sizes of
+// dimension based operations by the dpr wherever it appears in the chain.
+// Operations that resize use the filter set by the last filter before them.
+// The chain must have been checked by parseOutput.
+func (s *server) applyTransformations(ctx context.Context, img image.Image, operations string, out output) (image.Image, error) {
+	filter := imaging.Lanczos
 	for _, op := range strings.Split(operations, ",") {
-		parts := strings.SplitN(op, "=", 2)
-		opName := parts[0]
-		opParam := ""
-		if len(parts) == 2 {
-			opParam = parts[1]
+		opName, opParam := parseOperation(op)
+		if opName == "filter" {
+			var exists bool
+			if filter, exists = filters[opParam]; !exists {
+				return nil, fmt.Errorf("error applying filter: unknown filter %q", opParam)
+			}
+			continue
+		}
+		transformFunc, exists := s.transformations[opName]
+		if resampleFunc, resamples := s.resampleTransformations[opName]; resamples {
+			transformFunc = func(img image.Image, param string) (image.Image, error) {
+				return resampleFunc(img, param, filter)
+			}
+			exists = true
 		}
-		if transformFunc, exists := transformations[opName]; exists {
+		if sourceFunc, readsSource := s.sourceTransformations[opName]; readsSource {
+			transformFunc = func(img image.Image, param string) (image.Image, error) {
+				return sourceFunc(ctx, img, param)
+			}
+			exists = true
+		}
+		if exists {
+			if out.dpr != 1 && dimensionOperations[opName] {
+				opParam = scaleDimensions(opParam, out.dpr)
+			}
+			if out.noUpscale && upscaleOperations[opName] {
+				opParam = s.capDimensions(opParam, img.Bounds())
+			}
+			start := time.Now()
+			before := img.Bounds()
 			var err error
 			img, err = transformFunc(img, opParam)
+			processingDuration.WithLabelValues(opName).Observe(time.Since(start).Seconds())
+			operationsTotal.WithLabelValues(opName).Inc()
+			if err == nil {
+				// sources larger than the limits may pass through, but no step may grow past them
+				if after := img.Bounds(); after.Dx() > before.Dx() || after.Dy() > before.Dy() {
+					err = s.checkDimensions(after.Dx(), after.Dy())
+				}
+			}
 			if err != nil {
+				operationErrors.WithLabelValues(opName).Inc()
 				return nil, fmt.Errorf("error applying %s: %v", opName, err)
 			}
 		}
@@ -104,11 +592,285 @@ func applyTransformations(img image.Image, operations string) (image.Image, erro
 	return img, nil
 }
 
-func generateCacheKey(filename, operations string) string {
-	hash := md5.Sum([]byte(filename + operations))
+// generateCacheKey names a rendering, version changes with the source file so edits aren't hidden by the cache.
+// The resolved quality and metadata choice are part of it too, they can come from the config rather than the url.
+func generateCacheKey(filename, version, operations string, out output) string {
+	fields := []string{filename, version, operations, out.format, strconv.Itoa(out.quality), strconv.FormatBool(out.keepMetadata)}
+	hash := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
 	return hex.EncodeToString(hash[:])
 }
 
+func negotiateFormat(accept string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.TrimSpace(params[0])
+		accepted[mediaType] = 1
+		for _, param := range params[1:] {
+			if value, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				q, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+				accepted[mediaType] = q
+			}
+		}
+	}
+	format, best := "", 0.0
+	for _, candidate := range negotiableFormats {
+		if q := accepted["image/"+candidate]; q > best {
+			format, best = candidate, q
+		}
+	}
+	return format
+}
+
+// decodeImage reads the header first and refuses sources declaring more than
+// maxSourceMegapixels, so a small file can't decode into an enormous image.
+// Data that can't be decoded fails with errUndecodable.
+func (s *server) decodeImage(data []byte, autoOrient bool) (image.Image, string, error) {
+	header, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	if s.cfg.MaxSourceMegapixels > 0 && float64(header.Width)*float64(header.Height) > s.cfg.MaxSourceMegapixels*1e6 {
+		return nil, format, errSourceTooBig
+	}
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(autoOrient))
+	if err != nil {
+		return nil, format, fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	return img, format, nil
+}
+
+func sourceFormat(format string) string {
+	if _, exists := formats[format]; exists {
+		return format
+	}
+	return "jpeg"
+}
+
+func outputImage(img image.Image, out output) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, out); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if out.format == "jpeg" {
+		data = insertJPEGMetadata(data, out.metadata)
+	}
+	return data, nil
+}
+
+func encodeImage(w io.Writer, img image.Image, out output) error {
+	switch out.format {
+	case "avif":
+		options := avif.Options{
+			Quality:           out.quality,
+			QualityAlpha:      out.quality,
+			Speed:             out.speed,
+			ChromaSubsampling: image.YCbCrSubsampleRatio420,
+		}
+		return avif.Encode(w, img, options)
+	case "webp":
+		options := webp.Options{Quality: out.quality, Method: webp.DefaultMethod}
+		return webp.Encode(w, img, options)
+	case "jpeg":
+		if hasAlpha(img) {
+			img = flatten(img, color.White)
+		}
+		if out.progressive {
+			quality := out.quality
+			if quality == 0 {
+				quality = 95
+			}
+			return encodeProgressiveJPEG(w, img, quality)
+		}
+		fallthrough
+	default:
+		format, err := imaging.FormatFromExtension(formats[out.format])
+		if err != nil {
+			return err
+		}
+		var options []imaging.EncodeOption
+		if out.quality > 0 {
+			options = append(options, imaging.JPEGQuality(out.quality))
+		}
+		options = append(options, imaging.PNGCompressionLevel(out.compression))
+		return imaging.Encode(w, img, format, options...)
+	}
+}
+
+func cachedImageConfig(data []byte) (int, int, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return config.Width, config.Height, format, nil
+}
+
+// notModified reports whether the client's copy is current, If-None-Match wins over If-Modified-Since.
+// A wildcard If-None-Match only matches when the source is known to exist.
+func notModified(c *gin.Context, etag string, exists bool, modified time.Time) bool {
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag, exists)
+	}
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+func etagMatches(ifNoneMatch, etag string, exists bool) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || (candidate == "*" && exists) {
+			return true
+		}
+	}
+	return false
+}
+
+func flatten(img image.Image, background color.Color) image.Image {
+	bounds := img.Bounds()
+	canvas := imaging.New(bounds.Dx(), bounds.Dy(), background)
+	return imaging.Overlay(canvas, img, image.Pt(0, 0), 1)
+}
+
+func hasAlpha(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *server) setCacheHeaders(c *gin.Context, cacheKey string, modified time.Time) {
+	c.Header("ETag", `"`+cacheKey+`"`)
+	if !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Vary", "Accept")
+	if s.cfg.CacheMaxAge > 0 {
+		directives := fmt.Sprintf("public, max-age=%d", s.cfg.CacheMaxAge)
+		if s.cfg.CacheStaleWhileRevalidate > 0 {
+			directives += fmt.Sprintf(", stale-while-revalidate=%d", s.cfg.CacheStaleWhileRevalidate)
+		}
+		if s.cfg.CacheImmutable {
+			directives += ", immutable"
+		}
+		c.Header("Cache-Control", directives)
+		c.Header("Expires", time.Now().Add(time.Duration(s.cfg.CacheMaxAge)*time.Second).UTC().Format(http.TimeFormat))
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+}
+
+func setSizeHeaders(c *gin.Context, width, height int) {
+	c.Header("X-Image-Width", strconv.Itoa(width))
+	c.Header("X-Image-Height", strconv.Itoa(height))
+}
+
+func outputAutoOrient(out *output, param string) error {
+	autoOrient, err := strconv.ParseBool(param)
+	if err != nil {
+		return fmt.Errorf("invalid auto_orient value")
+	}
+	out.autoOrient = autoOrient
+	return nil
+}
+
+func outputDPR(out *output, param string) error {
+	dpr, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsNaN(dpr) {
+		return fmt.Errorf("invalid dpr")
+	}
+	out.dpr = min(max(dpr, 1), 4)
+	return nil
+}
+
+func outputFormat(out *output, param string) error {
+	parts := strings.Split(param, "@")
+	if _, exists := formats[parts[0]]; !exists {
+		return fmt.Errorf("unsupported format %q", parts[0])
+	}
+	out.format = parts[0]
+	out.negotiated = false
+	if len(parts) < 2 {
+		return nil
+	}
+	return outputQuality(out, parts[1])
+}
+
+func outputKeepMetadata(out *output, param string) error {
+	keepMetadata, err := strconv.ParseBool(param)
+	if err != nil {
+		return fmt.Errorf("invalid keep_metadata value")
+	}
+	out.keepMetadata = keepMetadata
+	return nil
+}
+
+func outputNoUpscale(out *output, param string) error {
+	noUpscale, err := strconv.ParseBool(param)
+	if err != nil {
+		return fmt.Errorf("invalid no_upscale value")
+	}
+	out.noUpscale = noUpscale
+	return nil
+}
+
+func outputPNGCompression(out *output, param string) error {
+	switch param {
+	case "default":
+		out.compression = png.DefaultCompression
+	case "none":
+		out.compression = png.NoCompression
+	case "fast":
+		out.compression = png.BestSpeed
+	case "best":
+		out.compression = png.BestCompression
+	default:
+		return fmt.Errorf("invalid compression level")
+	}
+	return nil
+}
+
+func outputProgressive(out *output, param string) error {
+	progressive, err := strconv.ParseBool(param)
+	if err != nil {
+		return fmt.Errorf("invalid progressive value")
+	}
+	if progressive && !progressiveJPEG {
+		return fmt.Errorf("progressive jpeg is not supported by this build")
+	}
+	out.progressive = progressive
+	return nil
+}
+
+func outputQuality(out *output, param string) error {
+	quality, err := strconv.Atoi(param)
+	if err != nil || quality < 1 || quality > 100 {
+		return fmt.Errorf("invalid quality")
+	}
+	out.quality = quality
+	return nil
+}
+
+func outputSpeed(out *output, param string) error {
+	speed, err := strconv.Atoi(param)
+	if err != nil || speed < 1 || speed > 10 {
+		return fmt.Errorf("invalid speed")
+	}
+	out.speed = speed
+	return nil
+}
+
 func imageEffect(effectFunc func(image.Image, float64) *image.NRGBA) func(image.Image, string) (image.Image, error) {
 	return func(img image.Image, param string) (image.Image, error) {
 		value, err := strconv.ParseFloat(param, 64)
@@ -119,15 +881,84 @@ func imageEffect(effectFunc func(image.Image, float64) *image.NRGBA) func(image.
 	}
 }
 
-func imageCrop(img image.Image, param string) (image.Image, error) {
+func imageBackground(img image.Image, param string) (image.Image, error) {
+	background, err := parseColor(param)
+	if err != nil {
+		return nil, err
+	}
+	return flatten(img, background), nil
+}
+
+func imageBlur(img image.Image, param string) (image.Image, error) {
+	sigma, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsInf(sigma, 0) {
+		return nil, fmt.Errorf("invalid parameter value")
+	}
+	if !(sigma > 0) || sigma > 100 {
+		return nil, fmt.Errorf("blur sigma must be greater than 0 and at most 100")
+	}
+	return imaging.Blur(img, sigma), nil
+}
+
+func (s *server) imageBorder(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid border parameters")
+	}
+	widths := strings.Split(parts[0], "x")
+	if len(widths) != 1 && len(widths) != 4 {
+		return nil, fmt.Errorf("border width must be a single value or top x right x bottom x left")
+	}
+	sides := make([]int, len(widths))
+	for i, w := range widths {
+		width, err := strconv.Atoi(w)
+		if err != nil || width < 0 {
+			return nil, fmt.Errorf("border width must be a non-negative integer")
+		}
+		sides[i] = width
+	}
+	if len(sides) == 1 {
+		sides = []int{sides[0], sides[0], sides[0], sides[0]}
+	}
+	background, err := parseColor(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	top, right, bottom, left := sides[0], sides[1], sides[2], sides[3]
+	bounds := img.Bounds()
+	width, height := bounds.Dx()+left+right, bounds.Dy()+top+bottom
+	if err := s.checkDimensions(width, height); err != nil {
+		return nil, err
+	}
+	canvas := imaging.New(width, height, background)
+	return imaging.Paste(canvas, img, image.Pt(left, top)), nil
+}
+
+func imageCircle(img image.Image, _ string) (image.Image, error) {
+	bounds := img.Bounds()
+	size := min(bounds.Dx(), bounds.Dy())
+	square := imaging.CropCenter(img, size, size)
+	return roundCorners(square, float64(size)/2), nil
+}
+
+func (s *server) imageCrop(img image.Image, param string) (image.Image, error) {
 	parts := strings.Split(param, "@")
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid crop parameters")
 	}
-	width, height, err := parseDimensions(parts[0])
+	width, height, err := s.parseDimensions(parts[0])
 	if err != nil {
 		return nil, err
 	}
+	if focal, isFocal, err := parseFocal(parts[1]); isFocal {
+		if err != nil {
+			return nil, err
+		}
+		return imaging.Crop(img, focalRegion(img.Bounds(), width, height, focal)), nil
+	}
+	if parts[1] == "entropy" {
+		return imaging.Crop(img, entropyRegion(img, width, height)), nil
+	}
 	anchorPoint, err := parseAnchor(parts[1])
 	if err != nil {
 		return nil, err
@@ -135,28 +966,75 @@ func imageCrop(img image.Image, param string) (image.Image, error) {
 	return imaging.CropAnchor(img, width, height, anchorPoint), nil
 }
 
-func imageFill(img image.Image, param string) (image.Image, error) {
+func imageDuotone(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("duotone takes a shadow and a highlight color")
+	}
+	shadow, err := parseColor(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow color %q", parts[0])
+	}
+	highlight, err := parseColor(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid highlight color %q", parts[1])
+	}
+	return imaging.AdjustFunc(imaging.Grayscale(img), func(c color.NRGBA) color.NRGBA {
+		t := float64(c.R) / 255
+		return color.NRGBA{
+			R: clamp(float64(shadow.R) + (float64(highlight.R)-float64(shadow.R))*t),
+			G: clamp(float64(shadow.G) + (float64(highlight.G)-float64(shadow.G))*t),
+			B: clamp(float64(shadow.B) + (float64(highlight.B)-float64(shadow.B))*t),
+			A: c.A,
+		}
+	}), nil
+}
+
+func (s *server) imageFill(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
 	parts := strings.Split(param, "@")
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("invalid crop parameters")
 	}
-	width, height, err := parseDimensions(parts[0])
+	width, height, err := s.parseDimensions(parts[0])
 	if err != nil {
 		return nil, err
 	}
+	if focal, isFocal, err := parseFocal(parts[1]); isFocal {
+		if err != nil {
+			return nil, err
+		}
+		if width < 1 || height < 1 {
+			return nil, fmt.Errorf("width and height must be positive")
+		}
+		bounds := img.Bounds()
+		cropWidth, cropHeight := bounds.Dx(), max(int(math.Round(float64(bounds.Dx())*float64(height)/float64(width))), 1)
+		if cropHeight > bounds.Dy() {
+			cropWidth, cropHeight = max(int(math.Round(float64(bounds.Dy())*float64(width)/float64(height))), 1), bounds.Dy()
+		}
+		region := focalRegion(bounds, cropWidth, cropHeight, focal)
+		return imaging.Resize(imaging.Crop(img, region), width, height, filter), nil
+	}
 	anchor, err := parseAnchor(parts[1])
 	if err != nil {
 		return nil, err
 	}
-	return imaging.Fill(img, width, height, anchor, imaging.Lanczos), nil
+	return imaging.Fill(img, width, height, anchor, filter), nil
 }
 
-func imageFit(img image.Image, param string) (image.Image, error) {
-	width, height, err := parseDimensions(param)
+func (s *server) imageFit(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
+	width, height, err := s.parseDimensions(param)
 	if err != nil {
 		return nil, err
 	}
-	return imaging.Fit(img, width, height, imaging.Lanczos), nil
+	return imaging.Fit(img, width, height, filter), nil
+}
+
+func imageFlipH(img image.Image, _ string) (image.Image, error) {
+	return imaging.FlipH(img), nil
+}
+
+func imageFlipV(img image.Image, _ string) (image.Image, error) {
+	return imaging.FlipV(img), nil
 }
 
 func imageGrayscale(img image.Image, _ string) (image.Image, error) {
@@ -167,12 +1045,431 @@ func imageInvert(img image.Image, _ string) (image.Image, error) {
 	return imaging.Invert(img), nil
 }
 
-func imageResize(img image.Image, param string) (image.Image, error) {
-	width, height, err := parseDimensions(param)
+func imageNoise(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid noise parameters")
+	}
+	deviation, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || deviation < 0 || deviation > 255 {
+		return nil, fmt.Errorf("standard deviation must be between 0 and 255")
+	}
+	seed := int64(1)
+	if len(parts) == 2 {
+		if seed, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("seed must be an integer")
+		}
+	}
+	random := rand.New(rand.NewSource(seed))
+	dst := imaging.Clone(img)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for ch := i; ch < i+3; ch++ {
+			dst.Pix[ch] = clamp(float64(dst.Pix[ch]) + random.NormFloat64()*deviation)
+		}
+	}
+	return dst, nil
+}
+
+func imageNormalize(img image.Image, _ string) (image.Image, error) {
+	src := imaging.Clone(img)
+	low, high := uint8(255), uint8(0)
+	for i := 0; i < len(src.Pix); i += 4 {
+		if src.Pix[i+3] == 0 {
+			continue
+		}
+		low = min(low, src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+		high = max(high, src.Pix[i], src.Pix[i+1], src.Pix[i+2])
+	}
+	if high <= low {
+		return src, nil
+	}
+	scale := 255 / float64(high-low)
+	return imaging.AdjustFunc(src, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{
+			R: clamp(float64(int(c.R)-int(low)) * scale),
+			G: clamp(float64(int(c.G)-int(low)) * scale),
+			B: clamp(float64(int(c.B)-int(low)) * scale),
+			A: c.A,
+		}
+	}), nil
+}
+
+func (s *server) imagePad(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid pad parameters")
+	}
+	width, height, err := s.parseDimensions(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	background := namedColors["white"]
+	if len(parts) > 1 {
+		if background, err = parseColor(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	anchor := imaging.Center
+	if len(parts) > 2 {
+		if anchor, err = parseAnchor(parts[2]); err != nil {
+			return nil, err
+		}
+	}
+	fitted := imaging.Fit(img, width, height, filter)
+	canvas := imaging.New(width, height, background)
+	position := anchorPoint(canvas.Bounds().Size(), fitted.Bounds().Size(), anchor)
+	return imaging.Paste(canvas, fitted, position), nil
+}
+
+func imagePixelate(img image.Image, param string) (image.Image, error) {
+	size, err := strconv.Atoi(param)
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("block size must be a positive integer")
+	}
+	bounds := img.Bounds()
+	width := (bounds.Dx() + size - 1) / size
+	height := (bounds.Dy() + size - 1) / size
+	small := imaging.Resize(img, width, height, imaging.Box)
+	return imaging.Resize(small, bounds.Dx(), bounds.Dy(), imaging.NearestNeighbor), nil
+}
+
+func (s *server) imageResize(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
+	width, height, err := s.parseResizeDimensions(param)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Resize(img, width, height, filter), nil
+}
+
+func (s *server) imageRotate(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	angle, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsInf(angle, 0) || math.IsNaN(angle) {
+		return nil, fmt.Errorf("invalid angle")
+	}
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	background := color.NRGBA{}
+	if len(parts) == 2 {
+		if background, err = parseColor(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	switch angle {
+	case 0:
+		return img, nil
+	case 90:
+		return imaging.Rotate90(img), nil
+	case 180:
+		return imaging.Rotate180(img), nil
+	case 270:
+		return imaging.Rotate270(img), nil
+	}
+	bounds := img.Bounds()
+	if err := s.checkDimensions(rotatedSize(bounds.Dx(), bounds.Dy(), angle)); err != nil {
+		return nil, err
+	}
+	return imaging.Rotate(img, angle, background), nil
+}
+
+// rotatedSize returns the size of the box holding a width x height image rotated by angle degrees,
+// it may be a pixel larger than the image imaging.Rotate makes.
+func rotatedSize(width, height int, angle float64) (int, int) {
+	sin, cos := math.Sincos(math.Pi * angle / 180)
+	sin, cos = math.Abs(sin), math.Abs(cos)
+	w, h := float64(width-1), float64(height-1)
+	return int(math.Ceil(w*cos+h*sin)) + 1, int(math.Ceil(w*sin+h*cos)) + 1
+}
+
+func imageRotate90(img image.Image, _ string) (image.Image, error) {
+	return imaging.Rotate90(img), nil
+}
+
+func imageRotate180(img image.Image, _ string) (image.Image, error) {
+	return imaging.Rotate180(img), nil
+}
+
+func imageRotate270(img image.Image, _ string) (image.Image, error) {
+	return imaging.Rotate270(img), nil
+}
+
+func imageRound(img image.Image, param string) (image.Image, error) {
+	bounds := img.Bounds()
+	maxRadius := min(bounds.Dx(), bounds.Dy()) / 2
+	radius := maxRadius
+	if param != "max" {
+		var err error
+		if radius, err = strconv.Atoi(param); err != nil || radius < 0 {
+			return nil, fmt.Errorf("radius must be a non-negative integer or max")
+		}
+		radius = min(radius, maxRadius)
+	}
+	return roundCorners(img, float64(radius)), nil
+}
+
+func (s *server) imageScale(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
+	parts := strings.Split(param, "x")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid scale format")
+	}
+	widthPercent, err := parsePercent(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	heightPercent := widthPercent
+	if len(parts) == 2 {
+		if heightPercent, err = parsePercent(parts[1]); err != nil {
+			return nil, err
+		}
+	}
+	bounds := img.Bounds()
+	width := max(1, int(math.Round(float64(bounds.Dx())*widthPercent/100)))
+	height := max(1, int(math.Round(float64(bounds.Dy())*heightPercent/100)))
+	if err := s.checkDimensions(width, height); err != nil {
+		return nil, err
+	}
+	return imaging.Resize(img, width, height, filter), nil
+}
+
+func imageSepia(img image.Image, param string) (image.Image, error) {
+	intensity := 100.0
+	if param != "" {
+		var err error
+		if intensity, err = strconv.ParseFloat(param, 64); err != nil || intensity < 0 || intensity > 100 {
+			return nil, fmt.Errorf("intensity must be between 0 and 100")
+		}
+	}
+	amount := intensity / 100
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		return color.NRGBA{
+			R: clamp(r + (0.393*r+0.769*g+0.189*b-r)*amount),
+			G: clamp(g + (0.349*r+0.686*g+0.168*b-g)*amount),
+			B: clamp(b + (0.272*r+0.534*g+0.131*b-b)*amount),
+			A: c.A,
+		}
+	}), nil
+}
+
+func imageSharpen(img image.Image, param string) (image.Image, error) {
+	sigma, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsInf(sigma, 0) {
+		return nil, fmt.Errorf("invalid parameter value")
+	}
+	if !(sigma >= 0) || sigma > 100 {
+		return nil, fmt.Errorf("sharpen sigma must be between 0 and 100")
+	}
+	return imaging.Sharpen(img, sigma), nil
+}
+
+func imageTint(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid tint parameters")
+	}
+	tint, err := parseColor(parts[0])
 	if err != nil {
 		return nil, err
 	}
-	return imaging.Resize(img, width, height, imaging.Lanczos), nil
+	opacity, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || opacity < 0 || opacity > 1 {
+		return nil, fmt.Errorf("opacity must be between 0 and 1")
+	}
+	bounds := img.Bounds()
+	overlay := imaging.New(bounds.Dx(), bounds.Dy(), tint)
+	return imaging.Overlay(img, overlay, image.Pt(0, 0), opacity), nil
+}
+
+func imageTrim(img image.Image, param string) (image.Image, error) {
+	tolerance := 0
+	if param != "" {
+		var err error
+		if tolerance, err = strconv.Atoi(param); err != nil || tolerance < 0 || tolerance > 255 {
+			return nil, fmt.Errorf("tolerance must be between 0 and 255")
+		}
+	}
+	src := imaging.Clone(img)
+	bounds := src.Bounds()
+	reference := src.NRGBAAt(0, 0)
+	matches := func(x, y int) bool {
+		c := src.NRGBAAt(x, y)
+		return channelDiff(c.R, reference.R) <= tolerance && channelDiff(c.G, reference.G) <= tolerance &&
+			channelDiff(c.B, reference.B) <= tolerance && channelDiff(c.A, reference.A) <= tolerance
+	}
+	rowMatches := func(y, left, right int) bool {
+		for x := left; x < right; x++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	columnMatches := func(x, top, bottom int) bool {
+		for y := top; y < bottom; y++ {
+			if !matches(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top, bottom, left, right := 0, bounds.Dy(), 0, bounds.Dx()
+	for top < bottom && rowMatches(top, left, right) {
+		top++
+	}
+	if top == bottom {
+		return img, nil
+	}
+	for rowMatches(bottom-1, left, right) {
+		bottom--
+	}
+	for columnMatches(left, top, bottom) {
+		left++
+	}
+	for columnMatches(right-1, top, bottom) {
+		right--
+	}
+	return imaging.Crop(src, image.Rect(left, top, right, bottom)), nil
+}
+
+func imageUnsharp(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "x")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("unsharp takes amount x radius x threshold")
+	}
+	amount, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || amount < 0 || amount > 10 {
+		return nil, fmt.Errorf("amount must be between 0 and 10")
+	}
+	radius, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || radius <= 0 || radius > 100 {
+		return nil, fmt.Errorf("radius must be greater than 0 and at most 100")
+	}
+	threshold, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("threshold must be between 0 and 1")
+	}
+	src := imaging.Clone(img)
+	blurred := imaging.Blur(src, radius)
+	limit := threshold * 255
+	for i := 0; i < len(src.Pix); i += 4 {
+		for ch := i; ch < i+3; ch++ {
+			diff := float64(src.Pix[ch]) - float64(blurred.Pix[ch])
+			if math.Abs(diff) > limit {
+				src.Pix[ch] = clamp(float64(src.Pix[ch]) + amount*diff)
+			}
+		}
+	}
+	return src, nil
+}
+
+func imageVignette(img image.Image, param string) (image.Image, error) {
+	intensity, err := strconv.ParseFloat(param, 64)
+	if err != nil || intensity < 0 || intensity > 1 {
+		return nil, fmt.Errorf("intensity must be between 0 and 1")
+	}
+	dst := imaging.Clone(img)
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	cx, cy := float64(width)/2, float64(height)/2
+	corner := math.Hypot(cx, cy)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			distance := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / corner
+			factor := 1 - intensity*distance*distance
+			i := y*dst.Stride + x*4
+			for ch := i; ch < i+3; ch++ {
+				dst.Pix[ch] = clamp(float64(dst.Pix[ch]) * factor)
+			}
+		}
+	}
+	return dst, nil
+}
+
+func (s *server) imageWatermark(ctx context.Context, img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid watermark parameters")
+	}
+	anchor, err := parseAnchor(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	opacity, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || opacity < 0 || opacity > 1 {
+		return nil, fmt.Errorf("opacity must be between 0 and 1")
+	}
+	if isRemote(parts[0]) || !filepath.IsLocal(parts[0]) {
+		return nil, fmt.Errorf("invalid watermark filename")
+	}
+	data, err := s.readSource(ctx, parts[0])
+	if errors.Is(err, errSourceTooLarge) {
+		return nil, fmt.Errorf("watermark is too large")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("watermark not found")
+	}
+	mark, _, err := s.decodeImage(data, false)
+	if errors.Is(err, errSourceTooBig) {
+		return nil, fmt.Errorf("watermark has too many pixels")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid watermark image")
+	}
+	bounds := img.Bounds()
+	if mark.Bounds().Dx() > bounds.Dx() || mark.Bounds().Dy() > bounds.Dy() {
+		mark = imaging.Fit(mark, bounds.Dx(), bounds.Dy(), imaging.Lanczos)
+	}
+	position := anchorPoint(bounds.Size(), mark.Bounds().Size(), anchor)
+	return imaging.Overlay(img, mark, position, opacity), nil
+}
+
+func anchorPoint(outer, inner image.Point, anchor imaging.Anchor) image.Point {
+	x, y := (outer.X-inner.X)/2, (outer.Y-inner.Y)/2
+	switch anchor {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = 0
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = outer.X - inner.X
+	}
+	switch anchor {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = 0
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = outer.Y - inner.Y
+	}
+	return image.Pt(x, y)
+}
+
+func roundCorners(img image.Image, radius float64) *image.NRGBA {
+	dst := imaging.Clone(img)
+	width, height := dst.Bounds().Dx(), dst.Bounds().Dy()
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// distance from the pixel centre to the centre of the nearest corner arc
+			dx := math.Max(radius-(float64(x)+0.5), float64(x)+0.5-(float64(width)-radius))
+			dy := math.Max(radius-(float64(y)+0.5), float64(y)+0.5-(float64(height)-radius))
+			if dx <= 0 || dy <= 0 {
+				continue
+			}
+			coverage := math.Min(math.Max(radius-math.Hypot(dx, dy)+0.5, 0), 1)
+			i := dst.PixOffset(x, y) + 3
+			dst.Pix[i] = clamp(float64(dst.Pix[i]) * coverage)
+		}
+	}
+	return dst
+}
+
+func channelDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func clamp(value float64) uint8 {
+	return uint8(math.Min(math.Max(math.Round(value), 0), 255))
 }
 
 func parseAnchor(anchor string) (imaging.Anchor, error) {
@@ -200,7 +1497,63 @@ func parseAnchor(anchor string) (imaging.Anchor, error) {
 	}
 }
 
-func parseDimensions(dims string) (int, int, error) {
+// parseFocal reads a focal=XxY anchor, a pixel that crops are centered on.
+// It reports false when the anchor isn't a focal point at all.
+func parseFocal(anchor string) (image.Point, bool, error) {
+	coords, isFocal := strings.CutPrefix(anchor, "focal=")
+	if !isFocal {
+		return image.Point{}, false, nil
+	}
+	xValue, yValue, found := strings.Cut(coords, "x")
+	x, xErr := strconv.Atoi(xValue)
+	y, yErr := strconv.Atoi(yValue)
+	if !found || xErr != nil || yErr != nil || x < 0 || y < 0 {
+		return image.Point{}, true, fmt.Errorf("invalid focal point, expected focal=XxY")
+	}
+	return image.Pt(x, y), true, nil
+}
+
+// focalRegion returns a width x height rectangle centered on the focal point,
+// moved back inside bounds where it would stick out.
+func focalRegion(bounds image.Rectangle, width, height int, focal image.Point) image.Rectangle {
+	width, height = min(width, bounds.Dx()), min(height, bounds.Dy())
+	x := min(max(bounds.Min.X+focal.X-width/2, bounds.Min.X), bounds.Max.X-width)
+	y := min(max(bounds.Min.Y+focal.Y-height/2, bounds.Min.Y), bounds.Max.Y-height)
+	return image.Rect(x, y, x+width, y+height)
+}
+
+func parseColor(value string) (color.NRGBA, error) {
+	if c, exists := namedColors[strings.ToLower(value)]; exists {
+		return c, nil
+	}
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 && len(value) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color")
+	}
+	rgba, err := hex.DecodeString(value)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color")
+	}
+	c := color.NRGBA{R: rgba[0], G: rgba[1], B: rgba[2], A: 255}
+	if len(rgba) == 4 {
+		c.A = rgba[3]
+	}
+	return c, nil
+}
+
+// parseDimensions parses the WxH of operations that need both sides.
+func (s *server) parseDimensions(dims string) (int, int, error) {
+	width, height, err := s.splitDimensions(dims)
+	if err != nil {
+		return 0, 0, err
+	}
+	if width < 1 || height < 1 {
+		return 0, 0, fmt.Errorf("width and height must be positive")
+	}
+	return width, height, nil
+}
+
+func (s *server) splitDimensions(dims string) (int, int, error) {
 	parts := strings.Split(dims, "x")
 	if len(parts) != 2 {
 		return 0, 0, fmt.Errorf("invalid dimensions format")
@@ -216,5 +1569,99 @@ func parseDimensions(dims string) (int, int, error) {
 		return 0, 0, fmt.Errorf("invalid height")
 	}
 
+	if err := s.checkDimensions(width, height); err != nil {
+		return 0, 0, err
+	}
 	return width, height, nil
 }
+
+// scaleDimensions multiplies the leading WxH of an operation parameter by factor,
+// parameters that don't start with dimensions are returned as they are.
+func scaleDimensions(param string, factor float64) string {
+	dims, rest, hasRest := strings.Cut(param, "@")
+	sides := strings.Split(dims, "x")
+	for i, side := range sides {
+		value, err := strconv.Atoi(side)
+		if err != nil {
+			return param
+		}
+		sides[i] = strconv.Itoa(int(math.Round(float64(value) * factor)))
+	}
+	if hasRest {
+		return strings.Join(sides, "x") + "@" + rest
+	}
+	return strings.Join(sides, "x")
+}
+
+// capDimensions shrinks the leading WxH of an operation parameter so neither side
+// is larger than bounds, keeping the requested aspect ratio.
+func (s *server) capDimensions(param string, bounds image.Rectangle) string {
+	dims, rest, hasRest := strings.Cut(param, "@")
+	width, height, err := s.parseResizeDimensions(dims)
+	if err != nil {
+		return param
+	}
+	factor := 1.0
+	if width > bounds.Dx() {
+		factor = float64(bounds.Dx()) / float64(width)
+	}
+	if height > bounds.Dy() {
+		factor = min(factor, float64(bounds.Dy())/float64(height))
+	}
+	if factor == 1 {
+		return param
+	}
+	// a zero side is left for the resize to work out, others keep at least a pixel
+	capped := func(side int) int {
+		if side == 0 {
+			return 0
+		}
+		return max(1, int(math.Round(float64(side)*factor)))
+	}
+	dims = fmt.Sprintf("%dx%d", capped(width), capped(height))
+	if hasRest {
+		return dims + "@" + rest
+	}
+	return dims
+}
+
+// checkDimensions rejects sizes an operation may not ask for, a single zero side
+// is left for parseResizeDimensions to allow.
+func (s *server) checkDimensions(width, height int) error {
+	switch {
+	case width < 0 || height < 0:
+		return fmt.Errorf("width and height cannot be negative")
+	case width == 0 && height == 0:
+		return fmt.Errorf("width and height cannot both be zero")
+	case s.cfg.MaxDimension > 0 && (width > s.cfg.MaxDimension || height > s.cfg.MaxDimension):
+		return fmt.Errorf("width and height cannot exceed %d", s.cfg.MaxDimension)
+	case s.cfg.MaxImageWidth > 0 && width > s.cfg.MaxImageWidth:
+		return fmt.Errorf("width cannot exceed %d", s.cfg.MaxImageWidth)
+	case s.cfg.MaxImageHeight > 0 && height > s.cfg.MaxImageHeight:
+		return fmt.Errorf("height cannot exceed %d", s.cfg.MaxImageHeight)
+	case s.cfg.MaxMegapixels > 0 && float64(width)*float64(height) > s.cfg.MaxMegapixels*1e6:
+		return fmt.Errorf("dimensions cannot exceed %g megapixels", s.cfg.MaxMegapixels)
+	}
+	return nil
+}
+
+func parsePercent(value string) (float64, error) {
+	number, found := strings.CutSuffix(value, "%")
+	if !found {
+		return 0, fmt.Errorf("scale must be a percentage, eg 50%%")
+	}
+	percent, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsInf(percent, 0) || math.IsNaN(percent) || percent <= 0 {
+		return 0, fmt.Errorf("scale must be a positive percentage")
+	}
+	return percent, nil
+}
+
+// parseResizeDimensions accepts a lone width as shorthand for WIDTHx0, a zero
+// side is computed from the aspect ratio.
+func (s *server) parseResizeDimensions(dims string) (int, int, error) {
+	if !strings.Contains(dims, "x") {
+		dims += "x0"
+	}
+	return s.splitDimensions(dims)
+}
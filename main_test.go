@@ -0,0 +1,911 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server reading images from and caching into temporary directories.
+func newTestServer(t *testing.T, configure func(*config)) *server {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.ImageDir = t.TempDir()
+	cfg.CacheDir = t.TempDir()
+	if configure != nil {
+		configure(&cfg)
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// writeImage saves img into dir in the format of the name's extension.
+func writeImage(t *testing.T, dir, name string, img image.Image) {
+	t.Helper()
+	if err := imaging.Save(img, filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gradient returns an opaque image that differs from pixel to pixel.
+func gradient(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// similar reports whether every channel of a and b is within tolerance of each other, on an 8 bit scale.
+func similar(a, b color.Color, tolerance int) bool {
+	ca := color.NRGBAModel.Convert(a).(color.NRGBA)
+	cb := color.NRGBAModel.Convert(b).(color.NRGBA)
+	for _, d := range []int{
+		int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B), int(ca.A) - int(cb.A),
+	} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// get sends a GET for path to the server, headers are given as name, value pairs.
+func get(s *server, path string, headers ...string) *httptest.ResponseRecorder {
+	return request(s, http.MethodGet, path, headers...)
+}
+
+func request(s *server, method, path string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	s.router().ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody decodes the image in a response, failing the test unless it was a 200.
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder) image.Image {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	img, _, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestCacheHitServesTransformedImage(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(400, 300))
+
+	first := get(s, "/images/resize=200x0/photo.png")
+	if size := decodeBody(t, first).Bounds().Size(); size != image.Pt(200, 150) {
+		t.Fatalf("first response is %v, want 200x150", size)
+	}
+	second := get(s, "/images/resize=200x0/photo.png")
+	if size := decodeBody(t, second).Bounds().Size(); size != image.Pt(200, 150) {
+		t.Fatalf("cached response is %v, want 200x150", size)
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Error("cached response differs from the first render")
+	}
+	if info := get(s, "/info/resize=200x0/photo.png"); !strings.Contains(info.Body.String(), `"cache_hit":true`) {
+		t.Errorf("variant wasn't cached: %s", info.Body)
+	}
+}
+
+func TestBlurAndSharpenLimits(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	tests := map[string]int{
+		"blur=2":        http.StatusOK,
+		"blur=100":      http.StatusOK,
+		"blur=100.5":    http.StatusBadRequest,
+		"blur=1e300":    http.StatusBadRequest,
+		"blur=0":        http.StatusBadRequest,
+		"sharpen=0":     http.StatusOK,
+		"sharpen=101":   http.StatusBadRequest,
+		"sharpen=1e300": http.StatusBadRequest,
+		"sharpen=-1":    http.StatusBadRequest,
+	}
+	for operations, want := range tests {
+		if rec := get(s, "/images/"+operations+"/photo.png"); rec.Code != want {
+			t.Errorf("%s got status %d, want %d", operations, rec.Code, want)
+		}
+	}
+}
+
+func TestLargeSourceWithoutResize(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) {
+		cfg.MaxImageWidth = 100
+		cfg.MaxImageHeight = 100
+	})
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(300, 200))
+
+	rec := get(s, "/images/grayscale/photo.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if size := decodeBody(t, rec).Bounds().Size(); size != image.Pt(300, 200) {
+		t.Errorf("got size %v, want 300x200", size)
+	}
+	if rec := get(s, "/images/resize=200x0/photo.png"); rec.Code != http.StatusBadRequest {
+		t.Errorf("oversized resize got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEnlargingChainIsLimited(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) {
+		cfg.MaxImageWidth = 100
+		cfg.MaxImageHeight = 100
+	})
+	// grow doubles the image without checking the limits itself
+	s.transformations["grow"] = func(img image.Image, param string) (image.Image, error) {
+		bounds := img.Bounds()
+		return imaging.Resize(img, bounds.Dx()*2, bounds.Dy()*2, imaging.NearestNeighbor), nil
+	}
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(30, 20))
+
+	rec := get(s, "/images/grow/photo.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if size := decodeBody(t, rec).Bounds().Size(); size != image.Pt(60, 40) {
+		t.Errorf("got size %v, want 60x40", size)
+	}
+	for _, path := range []string{"/images/grow,grow/photo.png", "/images/grow,grow,grow/photo.png", "/images/border=30@black,border=30@black/photo.png"} {
+		if rec := get(s, path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s got status %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDimensionValidation(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.MaxDimension = 1000 })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	tests := map[string]int{
+		"resize=20x0":         http.StatusOK,
+		"resize=0x20":         http.StatusOK,
+		"resize=20":           http.StatusOK,
+		"resize=0x0":          http.StatusBadRequest,
+		"resize=-20x10":       http.StatusBadRequest,
+		"resize=2000x0":       http.StatusBadRequest,
+		"crop=20x10@center":   http.StatusOK,
+		"crop=0x10@center":    http.StatusBadRequest,
+		"crop=0x0@center":     http.StatusBadRequest,
+		"crop=-20x10@center":  http.StatusBadRequest,
+		"crop=2000x10@center": http.StatusBadRequest,
+		"fill=20x0":           http.StatusBadRequest,
+		"fit=0x20":            http.StatusBadRequest,
+		"pad=20x0":            http.StatusBadRequest,
+		"smartcrop=0x20":      http.StatusBadRequest,
+	}
+	for operations, want := range tests {
+		if rec := get(s, "/images/"+operations+"/photo.png"); rec.Code != want {
+			t.Errorf("%s got status %d, want %d", operations, rec.Code, want)
+		}
+	}
+}
+
+func TestIfNoneMatchWildcard(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	if rec := get(s, "/images/grayscale/photo.png", "If-None-Match", "*"); rec.Code != http.StatusNotModified {
+		t.Errorf("existing source got status %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	if rec := get(s, "/images/grayscale/missing.png", "If-None-Match", "*"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing source got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestCachingHeaders(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(s.cfg.ImageDir, "photo.png"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get(s, "/images/grayscale/photo.png")
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+		t.Errorf("got Cache-Control %q", got)
+	}
+	expires, err := http.ParseTime(rec.Header().Get("Expires"))
+	if err != nil || time.Until(expires) < 86000*time.Second {
+		t.Errorf("got Expires %q, want a day from now", rec.Header().Get("Expires"))
+	}
+	if got := rec.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want the source's %q", got, modified.Format(http.TimeFormat))
+	}
+}
+
+// pngHeader returns a png declaring width x height that ends without any pixel data.
+func pngHeader(width, height uint32) []byte {
+	chunk := func(kind string, data []byte) []byte {
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		out = append(out, kind...)
+		out = append(out, data...)
+		return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(append([]byte(kind), data...)))
+	}
+	ihdr := binary.BigEndian.AppendUint32(nil, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0) // 8 bit rgba
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = append(out, chunk("IHDR", ihdr)...)
+	return append(out, chunk("IEND", nil)...)
+}
+
+func TestUndecodableSources(t *testing.T) {
+	s := newTestServer(t, nil)
+	files := map[string][]byte{
+		"huge.png":      pngHeader(50000, 50000),
+		"truncated.png": pngHeader(100, 100),
+		"garbage.png":   []byte("not an image"),
+	}
+	for name, data := range files {
+		writeFile(t, s.cfg.ImageDir, name, data)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/images/grayscale/huge.png", http.StatusBadRequest},
+		{"/color/huge.png", http.StatusBadRequest},
+		{"/images/grayscale/truncated.png", http.StatusUnsupportedMediaType},
+		{"/images/grayscale/garbage.png", http.StatusUnsupportedMediaType},
+		{"/blurhash/garbage.png", http.StatusUnsupportedMediaType},
+		{"/images/grayscale/missing.png", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if rec := get(s, test.path); rec.Code != test.want {
+			t.Errorf("%s got status %d, want %d: %s", test.path, rec.Code, test.want, rec.Body)
+		}
+	}
+}
+
+func TestConcurrentMissesRenderOnce(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	var renders atomic.Int32
+	release := make(chan struct{})
+	s.transformations["grayscale"] = func(img image.Image, param string) (image.Image, error) {
+		renders.Add(1)
+		<-release
+		return imageGrayscale(img, param)
+	}
+
+	const requests = 10
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = get(s, "/images/grayscale/photo.png").Code
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d got status %d", i, code)
+		}
+	}
+	if n := renders.Load(); n != 1 {
+		t.Errorf("transformation ran %d times, want 1", n)
+	}
+}
+
+func TestAcceptNegotiatesFormat(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	tests := map[string]string{
+		"image/webp":                         "image/webp",
+		"image/avif,image/webp,*/*":          "image/avif",
+		"image/avif;q=0.5, image/webp;q=0.9": "image/webp",
+		"image/avif;q=0":                     "image/png",
+		"image/*":                            "image/png",
+		"":                                   "image/png",
+	}
+	for accept, want := range tests {
+		rec := get(s, "/images/grayscale/photo.png", "Accept", accept)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != want {
+			t.Errorf("Accept %q got status %d and Content-Type %q, want %s", accept, rec.Code, rec.Header().Get("Content-Type"), want)
+		}
+		if vary := rec.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("Accept %q got Vary %q, want Accept", accept, vary)
+		}
+	}
+}
+
+// alphaAt returns the 8 bit alpha of the pixel at x, y.
+func alphaAt(img image.Image, x, y int) uint8 {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A
+}
+
+func TestCircle(t *testing.T) {
+	img, err := imageCircle(gradient(60, 40), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(40, 40) {
+		t.Fatalf("got size %v, want 40x40", size)
+	}
+	if a := alphaAt(img, 20, 20); a != 255 {
+		t.Errorf("center has alpha %d, want 255", a)
+	}
+	for _, corner := range []image.Point{{0, 0}, {39, 0}, {0, 39}, {39, 39}} {
+		if a := alphaAt(img, corner.X, corner.Y); a != 0 {
+			t.Errorf("corner %v has alpha %d, want 0", corner, a)
+		}
+	}
+}
+
+func TestRoundCorners(t *testing.T) {
+	for _, param := range []string{"10", "max"} {
+		img, err := imageRound(gradient(60, 40), param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, corner := range []image.Point{{0, 0}, {59, 0}, {0, 39}, {59, 39}} {
+			if a := alphaAt(img, corner.X, corner.Y); a != 0 {
+				t.Errorf("round=%s corner %v has alpha %d, want 0", param, corner, a)
+			}
+		}
+		for _, inside := range []image.Point{{30, 20}, {30, 0}, {30, 39}} {
+			if a := alphaAt(img, inside.X, inside.Y); a != 255 {
+				t.Errorf("round=%s %v has alpha %d, want 255", param, inside, a)
+			}
+		}
+	}
+	if _, err := imageRound(gradient(60, 40), "-1"); err == nil {
+		t.Error("expected an error for a negative radius")
+	}
+}
+
+func TestPNGCompression(t *testing.T) {
+	s := newTestServer(t, nil)
+	noisy, err := imageNoise(gradient(200, 150), "20@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeImage(t, s.cfg.ImageDir, "photo.png", noisy)
+
+	sizes := make(map[string]int)
+	for _, level := range []string{"none", "best"} {
+		rec := get(s, "/images/png_compression="+level+"/photo.png")
+		decodeBody(t, rec)
+		sizes[level] = rec.Body.Len()
+	}
+	if sizes["best"] >= sizes["none"] {
+		t.Errorf("got sizes %v, want best smaller than none", sizes)
+	}
+	if rec := get(s, "/images/png_compression=max/photo.png"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown level got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSepia(t *testing.T) {
+	gray := imaging.New(4, 4, color.NRGBA{128, 128, 128, 255})
+	img, err := imageSepia(gray, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := color.NRGBAModel.Convert(img.At(1, 1)).(color.NRGBA)
+	if !(got.R > got.G && got.G > got.B) {
+		t.Errorf("got %v, want a warm brown with red over green over blue", got)
+	}
+	if want := (color.NRGBA{173, 154, 120, 255}); !similar(got, want, 1) {
+		t.Errorf("got %v, want about %v", got, want)
+	}
+}
+
+func TestSepiaIntensity(t *testing.T) {
+	gray := imaging.New(4, 4, color.NRGBA{128, 128, 128, 255})
+	tests := map[string]color.NRGBA{
+		"0":   {128, 128, 128, 255},
+		"50":  {150, 141, 124, 255},
+		"100": {173, 154, 120, 255},
+	}
+	for param, want := range tests {
+		img, err := imageSepia(gray, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.At(1, 1); got != want {
+			t.Errorf("sepia=%s got %v, want %v", param, got, want)
+		}
+	}
+	for _, param := range []string{"-1", "101", "strong"} {
+		if _, err := imageSepia(gray, param); err == nil {
+			t.Errorf("sepia=%s: expected an error", param)
+		}
+	}
+}
+
+func TestRotateThenResizeKeepsTheRotatedAspectRatio(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 100))
+
+	tests := map[string]image.Point{
+		"rotate90,resize=50x0":  image.Pt(50, 100),
+		"rotate270,resize=0x50": image.Pt(25, 50),
+		"rotate180,resize=50x0": image.Pt(50, 25),
+	}
+	for operations, want := range tests {
+		if size := decodeBody(t, get(s, "/images/"+operations+"/photo.png")).Bounds().Size(); size != want {
+			t.Errorf("%s got size %v, want %v", operations, size, want)
+		}
+	}
+}
+
+func TestFreeRotationSize(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 100))
+
+	got := decodeBody(t, get(s, "/images/rotate=30/photo.png")).Bounds().Size()
+	if want := image.Pt(rotatedSize(200, 100, 30)); got.X < want.X-1 || got.X > want.X || got.Y < want.Y-1 || got.Y > want.Y {
+		t.Errorf("got size %v, want about %v", got, want)
+	}
+	chain := strings.TrimSuffix(strings.Repeat("rotate=45,", 10), ",")
+	if rec := get(s, "/images/"+chain+"/photo.png"); rec.Code != http.StatusBadRequest {
+		t.Errorf("ten rotations by 45 got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTransparentSourceAsJPEG(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "overlay.png", imaging.New(20, 20, color.NRGBA{255, 0, 0, 128}))
+
+	tests := []struct {
+		operations  string
+		contentType string
+		want        color.NRGBA
+	}{
+		{"format=jpeg", "image/jpeg", color.NRGBA{255, 127, 127, 255}},
+		{"background=0000ff,format=jpeg", "image/jpeg", color.NRGBA{128, 0, 127, 255}},
+		{"background=black", "image/png", color.NRGBA{128, 0, 0, 255}},
+	}
+	for _, test := range tests {
+		rec := get(s, "/images/"+test.operations+"/overlay.png")
+		if got := rec.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s got Content-Type %q, want %s", test.operations, got, test.contentType)
+		}
+		if got := decodeBody(t, rec).At(10, 10); !similar(got, test.want, 6) {
+			t.Errorf("%s got %v, want about %v", test.operations, got, test.want)
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	framed := imaging.Paste(imaging.New(50, 40, color.White), gradient(30, 20), image.Pt(10, 10))
+	img, err := imageTrim(framed, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(30, 20) {
+		t.Errorf("got size %v, want 30x20", size)
+	}
+
+	// a border that isn't quite white is only trimmed with a tolerance.
+	framed = imaging.Paste(imaging.New(50, 40, color.White), imaging.New(50, 40, color.NRGBA{250, 250, 250, 255}), image.Pt(5, 5))
+	framed = imaging.Paste(framed, gradient(30, 20), image.Pt(10, 10))
+	for param, want := range map[string]image.Point{"": image.Pt(45, 35), "10": image.Pt(30, 20)} {
+		img, err := imageTrim(framed, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != want {
+			t.Errorf("trim=%s got size %v, want %v", param, size, want)
+		}
+	}
+}
+
+func TestResizeKeepsAspectRatio(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(600, 400))
+
+	tests := map[string]image.Point{
+		"resize=300":     image.Pt(300, 200),
+		"resize=300x0":   image.Pt(300, 200),
+		"resize=0x200":   image.Pt(300, 200),
+		"resize=150x150": image.Pt(150, 150),
+	}
+	for operations, want := range tests {
+		if size := decodeBody(t, get(s, "/images/"+operations+"/photo.png")).Bounds().Size(); size != want {
+			t.Errorf("%s got size %v, want %v", operations, size, want)
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 100))
+
+	tests := map[string]image.Point{
+		"scale=100%":     image.Pt(200, 100),
+		"scale=50%":      image.Pt(100, 50),
+		"scale=150%":     image.Pt(300, 150),
+		"scale=50%x200%": image.Pt(100, 200),
+	}
+	for operations, want := range tests {
+		if size := decodeBody(t, get(s, "/images/"+url.PathEscape(operations)+"/photo.png")).Bounds().Size(); size != want {
+			t.Errorf("%s got size %v, want %v", operations, size, want)
+		}
+	}
+	for _, operations := range []string{"scale=50", "scale=0%", "scale=-50%"} {
+		if rec := get(s, "/images/"+url.PathEscape(operations)+"/photo.png"); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s got status %d, want %d", operations, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDevicePixelRatio(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(1000, 500))
+
+	tests := map[string]int{
+		"resize=200x0,dpr=1":   200,
+		"resize=200x0,dpr=2":   400,
+		"dpr=1.5,resize=200x0": 300,
+		"resize=200x0,dpr=10":  800,
+		"resize=200x0,dpr=0.5": 200,
+		"fit=100x100,dpr=2":    200,
+	}
+	for operations, want := range tests {
+		if width := decodeBody(t, get(s, "/images/"+operations+"/photo.png")).Bounds().Dx(); width != want {
+			t.Errorf("%s got width %d, want %d", operations, width, want)
+		}
+	}
+}
+
+func TestNoUpscale(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(500, 250))
+
+	tests := map[string]image.Point{
+		"resize=2000x0":                         image.Pt(2000, 1000),
+		"resize=2000x0,no_upscale=true":         image.Pt(500, 250),
+		"resize=200x0,no_upscale=true":          image.Pt(200, 100),
+		"fill=1000x1000@center,no_upscale=true": image.Pt(250, 250),
+		"fill=1x4000@center,no_upscale=true":    image.Pt(1, 250),
+		"fit=2000x2000":                         image.Pt(500, 250),
+	}
+	for operations, want := range tests {
+		if size := decodeBody(t, get(s, "/images/"+operations+"/photo.png")).Bounds().Size(); size != want {
+			t.Errorf("%s got size %v, want %v", operations, size, want)
+		}
+	}
+}
+
+func TestChangedSourceIsRenderedAgain(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	first := get(s, "/images/resize=20/photo.png")
+	if size := decodeBody(t, first).Bounds().Size(); size != image.Pt(20, 15) {
+		t.Fatalf("got size %v, want 20x15", size)
+	}
+
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 40))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(s.cfg.ImageDir, "photo.png"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	second := get(s, "/images/resize=20/photo.png")
+	if size := decodeBody(t, second).Bounds().Size(); size != image.Pt(20, 20) {
+		t.Errorf("got size %v from the old source, want 20x20", size)
+	}
+	if first.Header().Get("ETag") == second.Header().Get("ETag") {
+		t.Error("the ETag didn't change with the source")
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(s.cfg.ImageDir, "photo.png"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[time.Time]int{
+		modified:                      http.StatusNotModified,
+		modified.Add(time.Hour):       http.StatusNotModified,
+		modified.Add(-time.Second):    http.StatusOK,
+		modified.Add(-24 * time.Hour): http.StatusOK,
+	}
+	for since, want := range tests {
+		rec := get(s, "/images/grayscale/photo.png", "If-Modified-Since", since.Format(http.TimeFormat))
+		if rec.Code != want {
+			t.Errorf("If-Modified-Since %s got status %d, want %d", since, rec.Code, want)
+		}
+	}
+
+	// If-None-Match wins when both are sent.
+	rec := get(s, "/images/grayscale/photo.png", "If-Modified-Since", modified.Format(http.TimeFormat), "If-None-Match", `"other"`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("mismatched If-None-Match got status %d, want 200", rec.Code)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*config)
+		want      string
+	}{
+		{"default", nil, "public, max-age=86400"},
+		{"directives", func(cfg *config) {
+			cfg.CacheMaxAge = 60
+			cfg.CacheStaleWhileRevalidate = 30
+			cfg.CacheImmutable = true
+		}, "public, max-age=60, stale-while-revalidate=30, immutable"},
+		{"disabled", func(cfg *config) { cfg.CacheMaxAge = 0 }, "no-cache"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, test.configure)
+			writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+			if got := get(s, "/images/grayscale/photo.png").Header().Get("Cache-Control"); got != test.want {
+				t.Errorf("got Cache-Control %q, want %q", got, test.want)
+			}
+			for _, path := range []string{"/images/grayscale/missing.png", "/images/reize=20/photo.png"} {
+				rec := get(s, path)
+				if got := rec.Header().Get("Cache-Control"); rec.Code < 400 || got != "no-store" {
+					t.Errorf("%s got status %d and Cache-Control %q, want an error with no-store", path, rec.Code, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowedOperations(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.AllowedOperations = []string{"resize", "format"} })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	tests := map[string]int{
+		"resize=20":             http.StatusOK,
+		"resize=20,format=jpeg": http.StatusOK,
+		"resize=20,":            http.StatusOK,
+		"grayscale":             http.StatusBadRequest,
+		"resize=20,quality=50":  http.StatusBadRequest,
+	}
+	for operations, want := range tests {
+		rec := get(s, "/images/"+operations+"/photo.png")
+		if rec.Code != want {
+			t.Errorf("%s got status %d, want %d", operations, rec.Code, want)
+		}
+		if want == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "is not allowed") {
+			t.Errorf("%s got %s, want the operation named as not allowed", operations, rec.Body)
+		}
+	}
+}
+
+func TestRefusedOperationsAreCheckedBeforeTheCache(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	decodeBody(t, get(s, "/images/grayscale/photo.png"))
+
+	s.cfg.AllowedOperations = []string{"resize"}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	for _, headers := range [][]string{{"If-Modified-Since", future}, {"If-None-Match", "*"}, nil} {
+		if rec := get(s, "/images/grayscale/photo.png", headers...); rec.Code != http.StatusBadRequest {
+			t.Errorf("disallowed operation with %v got status %d, want %d", headers, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := get(s, "/images/reize=20/photo.png", "If-None-Match", "*"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown operation with If-None-Match got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUnknownOperation(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	rec := get(s, "/images/resize=20,reize=10/photo.png")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `unknown operation "reize"`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+	// output options and empty entries aren't operations to reject.
+	if rec := get(s, "/images/resize=20,,quality=80/photo.png"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMaxOperations(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.MaxOperations = 3 })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	if rec := get(s, "/images/grayscale,invert,quality=80/photo.png"); rec.Code != http.StatusOK {
+		t.Errorf("3 operations got status %d, want 200", rec.Code)
+	}
+	rec := get(s, "/images/grayscale,invert,fliph,flipv/photo.png")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "at most 3") {
+		t.Errorf("4 operations got status %d: %s", rec.Code, rec.Body)
+	}
+
+	s.cfg.MaxOperations = 0
+	if rec := get(s, "/images/"+strings.Repeat("fliph,", 30)+"flipv/photo.png"); rec.Code != http.StatusOK {
+		t.Errorf("unlimited got status %d, want 200", rec.Code)
+	}
+}
+
+func TestQualityChangesSize(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 150))
+
+	previous := 0
+	for _, quality := range []string{"95", "75", "40", "10"} {
+		rec := get(s, "/images/format=jpeg,quality="+quality+"/photo.png")
+		decodeBody(t, rec)
+		if previous > 0 && rec.Body.Len() >= previous {
+			t.Errorf("quality %s is %d bytes, want less than the %d of the quality above it", quality, rec.Body.Len(), previous)
+		}
+		previous = rec.Body.Len()
+	}
+	for _, quality := range []string{"0", "101", "high"} {
+		if rec := get(s, "/images/format=jpeg,quality="+quality+"/photo.png"); rec.Code != http.StatusBadRequest {
+			t.Errorf("quality %s got status %d, want %d", quality, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCacheHitKeepsResizedDimensions(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(400, 300))
+
+	for _, hit := range []bool{false, true} {
+		info := get(s, "/info/resize=100/photo.png")
+		want := fmt.Sprintf(`"cache_hit":%v`, hit)
+		if !strings.Contains(info.Body.String(), want) || !strings.Contains(info.Body.String(), `"width":100`) || !strings.Contains(info.Body.String(), `"height":75`) {
+			t.Errorf("got %s, want 100x75 with %s", info.Body, want)
+		}
+
+		rec := get(s, "/images/resize=100/photo.png")
+		if w, h := rec.Header().Get("X-Image-Width"), rec.Header().Get("X-Image-Height"); w != "100" || h != "75" {
+			t.Errorf("got size headers %sx%s, want 100x75", w, h)
+		}
+		if size := decodeBody(t, rec).Bounds().Size(); size != image.Pt(100, 75) {
+			t.Errorf("got size %v, want 100x75", size)
+		}
+	}
+}
+
+func TestFlippingTwiceRestoresTheImage(t *testing.T) {
+	original := gradient(40, 30)
+	for _, flip := range []func(image.Image, string) (image.Image, error){imageFlipH, imageFlipV} {
+		once, err := flip(original, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(once, original) {
+			t.Error("a single flip left the image unchanged")
+		}
+		twice, err := flip(once, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(twice, original) {
+			t.Error("flipping twice didn't restore the image")
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	etag := get(s, "/images/grayscale/photo.png").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag sent")
+	}
+
+	tests := map[string]int{
+		etag:                    http.StatusNotModified,
+		"W/" + etag:             http.StatusNotModified,
+		`"other", ` + etag:      http.StatusNotModified,
+		`"other"`:               http.StatusOK,
+		strings.Trim(etag, `"`): http.StatusOK,
+	}
+	for ifNoneMatch, want := range tests {
+		rec := get(s, "/images/grayscale/photo.png", "If-None-Match", ifNoneMatch)
+		if rec.Code != want {
+			t.Errorf("If-None-Match %s got status %d, want %d", ifNoneMatch, rec.Code, want)
+		}
+		if rec.Code == http.StatusNotModified && (rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag) {
+			t.Errorf("If-None-Match %s: 304 carried a body or lost the ETag", ifNoneMatch)
+		}
+	}
+	// another variant of the same image has its own ETag.
+	if rec := get(s, "/images/invert/photo.png", "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("other variant got status %d, want 200", rec.Code)
+	}
+}
+
+func TestBorderSize(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(10, 10))
+
+	if size := decodeBody(t, get(s, "/images/border=5@black/photo.png")).Bounds().Size(); size != image.Pt(20, 20) {
+		t.Errorf("got size %v, want 20x20", size)
+	}
+	if size := decodeBody(t, get(s, "/images/border=1x2x3x4@black/photo.png")).Bounds().Size(); size != image.Pt(16, 14) {
+		t.Errorf("got size %v, want 16x14", size)
+	}
+	for _, operations := range []string{"border=5000@black", "border=2000@black,border=2000@black", "border=-1@black"} {
+		if rec := get(s, "/images/"+operations+"/photo.png"); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s got status %d, want %d", operations, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFlipsComposeWithCropAndResize(t *testing.T) {
+	s := newTestServer(t, nil)
+	src := gradient(40, 30)
+	writeImage(t, s.cfg.ImageDir, "photo.png", src)
+
+	tests := map[string]image.Image{
+		"crop=20x10@top-left,fliph,resize=10x0":     imaging.Resize(imaging.FlipH(imaging.CropAnchor(src, 20, 10, imaging.TopLeft)), 10, 0, imaging.Lanczos),
+		"resize=20x0,flipv,crop=10x10@bottom-right": imaging.CropAnchor(imaging.FlipV(imaging.Resize(src, 20, 0, imaging.Lanczos)), 10, 10, imaging.BottomRight),
+	}
+	for operations, want := range tests {
+		got := decodeBody(t, get(s, "/images/"+operations+"/photo.png"))
+		if got.Bounds().Size() != want.Bounds().Size() {
+			t.Errorf("%s got size %v, want %v", operations, got.Bounds().Size(), want.Bounds().Size())
+			continue
+		}
+		last := want.Bounds().Size().Sub(image.Pt(1, 1))
+		for _, corner := range []image.Point{{}, last} {
+			if g, w := got.At(corner.X, corner.Y), want.At(corner.X, corner.Y); !similar(g, w, 2) {
+				t.Errorf("%s got %v at %v, want %v", operations, g, corner, w)
+			}
+		}
+	}
+}
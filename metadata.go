@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	markerSOI   = 0xd8
+	markerEOI   = 0xd9
+	markerSOS   = 0xda
+	markerAPP1  = 0xe1
+	markerAPP15 = 0xef
+)
+
+func readJPEGMetadata(src io.Reader) ([]byte, error) {
+	r := bufio.NewReader(src)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != 0xff || header[1] != markerSOI {
+		return nil, nil
+	}
+
+	var metadata bytes.Buffer
+	for {
+		segment := make([]byte, 4)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		if segment[0] != 0xff {
+			return nil, fmt.Errorf("invalid jpeg marker")
+		}
+		marker := segment[1]
+		if marker == markerSOS || marker == markerEOI {
+			return metadata.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(segment[2:]))
+		if length < 2 {
+			return nil, fmt.Errorf("invalid jpeg segment length")
+		}
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if marker >= markerAPP1 && marker <= markerAPP15 {
+			metadata.Write(segment)
+			metadata.Write(data)
+		}
+	}
+}
+
+func resetOrientation(metadata []byte) {
+	for len(metadata) >= 4 {
+		length := int(binary.BigEndian.Uint16(metadata[2:4]))
+		if length < 2 || len(metadata) < length+2 {
+			return
+		}
+		segment := metadata[4 : length+2]
+		if metadata[1] == markerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			resetTIFFOrientation(segment[6:])
+		}
+		metadata = metadata[length+2:]
+	}
+}
+
+func resetTIFFOrientation(tiff []byte) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 0 || offset+2 > len(tiff) {
+		return
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			order.PutUint16(tiff[entry+8:], 1)
+			return
+		}
+	}
+}
+
+func insertJPEGMetadata(data, metadata []byte) []byte {
+	if len(data) < 2 || len(metadata) == 0 {
+		return data
+	}
+	result := make([]byte, 0, len(data)+len(metadata))
+	result = append(result, data[:2]...)
+	result = append(result, metadata...)
+	return append(result, data[2:]...)
+}
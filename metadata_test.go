@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"testing"
+)
+
+// gpsDatum is written as the GPSMapDatum of jpegWithExif so tests can find the gps block in output.
+const gpsDatum = "TESTDATUM"
+
+// jpegWithExif encodes img as a jpeg carrying an exif orientation and, with gps set, a gps block.
+func jpegWithExif(t *testing.T, img image.Image, orientation uint16, gps bool) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	order := binary.LittleEndian
+	entry := func(out []byte, tag, kind uint16, count, value uint32) []byte {
+		out = order.AppendUint16(out, tag)
+		out = order.AppendUint16(out, kind)
+		out = order.AppendUint32(out, count)
+		return order.AppendUint32(out, value)
+	}
+	entries := uint16(1)
+	if gps {
+		entries++
+	}
+	// the tiff header is 8 bytes, ifd0 follows it and the gps ifd follows ifd0.
+	gpsOffset := 8 + 2 + uint32(entries)*12 + 4
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = order.AppendUint16(tiff, entries)
+	tiff = entry(tiff, 0x0112, 3, 1, uint32(orientation))
+	if gps {
+		tiff = entry(tiff, 0x8825, 4, 1, gpsOffset)
+	}
+	tiff = order.AppendUint32(tiff, 0)
+	if gps {
+		datum := gpsDatum + "\x00"
+		tiff = order.AppendUint16(tiff, 1)
+		tiff = entry(tiff, 0x0012, 2, uint32(len(datum)), gpsOffset+2+12+4)
+		tiff = order.AppendUint32(tiff, 0)
+		tiff = append(tiff, datum...)
+	}
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, markerAPP1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	return insertJPEGMetadata(encoded.Bytes(), append(app1, segment...))
+}
+
+func TestMetadataIsStrippedUnlessKept(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeFile(t, s.cfg.ImageDir, "photo.jpg", jpegWithExif(t, gradient(40, 30), 1, true))
+
+	stripped := get(s, "/images/resize=20/photo.jpg")
+	decodeBody(t, stripped)
+	if bytes.Contains(stripped.Body.Bytes(), []byte(gpsDatum)) {
+		t.Error("gps metadata was left in the output")
+	}
+
+	kept := get(s, "/images/resize=20,keep_metadata=true/photo.jpg")
+	decodeBody(t, kept)
+	if !bytes.Contains(kept.Body.Bytes(), []byte(gpsDatum)) {
+		t.Error("keep_metadata=true dropped the gps metadata")
+	}
+
+	s.cfg.StripExif = true
+	if rec := get(s, "/images/resize=20,keep_metadata=true/photo.jpg"); rec.Code != http.StatusBadRequest {
+		t.Errorf("keep_metadata with stripExif got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAutoOrientAllOrientations(t *testing.T) {
+	// upright has a distinct color in each quadrant, so every flip and rotation shows.
+	upright := imaging.New(40, 20, color.White)
+	upright = imaging.Paste(upright, imaging.New(20, 10, color.NRGBA{255, 0, 0, 255}), image.Pt(0, 0))
+	upright = imaging.Paste(upright, imaging.New(20, 10, color.NRGBA{0, 255, 0, 255}), image.Pt(20, 0))
+	upright = imaging.Paste(upright, imaging.New(20, 10, color.NRGBA{0, 0, 255, 255}), image.Pt(0, 10))
+
+	// stored holds the image a camera would write for each orientation to display upright.
+	stored := map[uint16]image.Image{
+		1: upright,
+		2: imaging.FlipH(upright),
+		3: imaging.Rotate180(upright),
+		4: imaging.FlipV(upright),
+		5: imaging.Transpose(upright),
+		6: imaging.Rotate90(upright),
+		7: imaging.Transverse(upright),
+		8: imaging.Rotate270(upright),
+	}
+	s := newTestServer(t, nil)
+	for orientation, img := range stored {
+		name := fmt.Sprintf("orientation-%d.jpg", orientation)
+		writeFile(t, s.cfg.ImageDir, name, jpegWithExif(t, img, orientation, false))
+
+		got := decodeBody(t, get(s, "/images/format=png/"+name))
+		if size := got.Bounds().Size(); size != image.Pt(40, 20) {
+			t.Errorf("orientation %d got size %v, want 40x20", orientation, size)
+			continue
+		}
+		for _, p := range []image.Point{{10, 5}, {30, 5}, {10, 15}, {30, 15}} {
+			if !similar(got.At(p.X, p.Y), upright.At(p.X, p.Y), 32) {
+				t.Errorf("orientation %d got %v at %v, want %v", orientation, got.At(p.X, p.Y), p, upright.At(p.X, p.Y))
+			}
+		}
+	}
+
+	// auto_orient=false leaves the stored pixels alone.
+	got := decodeBody(t, get(s, "/images/format=png,auto_orient=false/orientation-6.jpg"))
+	if size := got.Bounds().Size(); size != image.Pt(20, 40) {
+		t.Errorf("auto_orient=false got size %v, want 20x40", size)
+	}
+}
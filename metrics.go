@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "go_image_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	processingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "go_image_processing_duration_seconds",
+		Help:    "Time taken to apply a single image operation.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"operation"})
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "go_image_operations_total",
+		Help: "Image operations applied, by operation name.",
+	}, []string{"operation"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "go_image_operation_errors_total",
+		Help: "Image operations that failed, by operation name.",
+	}, []string{"operation"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "go_image_cache_requests_total",
+		Help: "Cache lookups for image requests, by result (hit or miss).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, processingDuration, operationsTotal, operationErrors, cacheRequests)
+}
+
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
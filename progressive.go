@@ -0,0 +1,15 @@
+//go:build !libjpeg
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+const progressiveJPEG = false
+
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	return fmt.Errorf("progressive jpeg requires a build with the libjpeg tag")
+}
@@ -0,0 +1,94 @@
+//go:build libjpeg
+
+package main
+
+// image/jpeg can only write baseline JPEGs, so progressive output is handed to
+// the system libjpeg through cgo. Builds with this tag need cgo, the libjpeg
+// headers at compile time and the shared library at runtime, which is why it
+// is opt in rather than part of the default pure Go build.
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <setjmp.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <jpeglib.h>
+
+struct error_mgr {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+static void error_exit(j_common_ptr cinfo) {
+	longjmp(((struct error_mgr *)cinfo->err)->jump, 1);
+}
+
+static unsigned long encode_progressive(unsigned char *pixels, int width, int height, int quality, unsigned char **out) {
+	struct jpeg_compress_struct cinfo;
+	struct error_mgr jerr;
+	unsigned long size = 0;
+
+	cinfo.err = jpeg_std_error(&jerr.pub);
+	jerr.pub.error_exit = error_exit;
+	if (setjmp(jerr.jump)) {
+		jpeg_destroy_compress(&cinfo);
+		free(*out);
+		*out = NULL;
+		return 0;
+	}
+
+	jpeg_create_compress(&cinfo);
+	jpeg_mem_dest(&cinfo, out, &size);
+	cinfo.image_width = width;
+	cinfo.image_height = height;
+	cinfo.input_components = 3;
+	cinfo.in_color_space = JCS_RGB;
+	jpeg_set_defaults(&cinfo);
+	jpeg_set_quality(&cinfo, quality, TRUE);
+	jpeg_simple_progression(&cinfo);
+	jpeg_start_compress(&cinfo, TRUE);
+	while (cinfo.next_scanline < cinfo.image_height) {
+		JSAMPROW row = pixels + (unsigned long)cinfo.next_scanline * width * 3;
+		jpeg_write_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_compress(&cinfo);
+	jpeg_destroy_compress(&cinfo);
+	return size;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+const progressiveJPEG = true
+
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("cannot encode an empty image")
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	pixels := make([]byte, 0, width*height*3)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		pixels = append(pixels, rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2])
+	}
+
+	var out *C.uchar
+	size := C.encode_progressive((*C.uchar)(unsafe.Pointer(&pixels[0])), C.int(width), C.int(height), C.int(quality), &out)
+	if out == nil {
+		return fmt.Errorf("libjpeg failed to encode image")
+	}
+	defer C.free(unsafe.Pointer(out))
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
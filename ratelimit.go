@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limiterIdleTimeout is how long a client's limiter is kept after its last request.
+const limiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64
+}
+
+// rateLimiter keeps a token bucket per client ip. A nil rateLimiter allows everything.
+type rateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	clients sync.Map
+	now     func() time.Time
+}
+
+// newRateLimiter allows rps requests per second per client, now is the clock tokens are refilled by.
+func newRateLimiter(rps float64, burst int, now func() time.Time) *rateLimiter {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rps)))
+	}
+	return &rateLimiter{limit: rate.Limit(rps), burst: burst, now: now}
+}
+
+// allow takes a token for the client, responding with a 429 and returning false when it has none left.
+func (rl *rateLimiter) allow(c *gin.Context) bool {
+	if rl == nil {
+		return true
+	}
+	now := rl.now()
+	value, _ := rl.clients.LoadOrStore(c.ClientIP(), &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)})
+	client := value.(*clientLimiter)
+	client.lastSeen.Store(now.UnixNano())
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		abort(c, http.StatusTooManyRequests, "Too many requests", nil)
+		return false
+	}
+	return true
+}
+
+// evictLoop forgets idle clients every interval until ctx is done.
+func (rl *rateLimiter) evictLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.evictIdle()
+		}
+	}
+}
+
+// evictIdle forgets the clients that haven't made a request for limiterIdleTimeout.
+func (rl *rateLimiter) evictIdle() {
+	cutoff := rl.now().Add(-limiterIdleTimeout).UnixNano()
+	rl.clients.Range(func(key, value any) bool {
+		if value.(*clientLimiter).lastSeen.Load() < cutoff {
+			rl.clients.Delete(key)
+		}
+		return true
+	})
+}
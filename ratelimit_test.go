@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimitOnlyCountsCacheMisses(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.limiter = newRateLimiter(1, 1, clock.now)
+
+	steps := []struct {
+		advance time.Duration
+		path    string
+		want    int
+	}{
+		{0, "/images/resize=10/photo.png", http.StatusOK},
+		{0, "/images/resize=11/photo.png", http.StatusTooManyRequests},
+		{0, "/color/photo.png", http.StatusTooManyRequests},
+		{time.Second, "/color/photo.png", http.StatusOK},
+		{0, "/color/photo.png", http.StatusOK},
+		{0, "/images/resize=10/photo.png", http.StatusOK},
+		{0, "/images/resize=11/photo.png", http.StatusTooManyRequests},
+		{time.Second, "/blurhash/photo.png", http.StatusOK},
+		{0, "/blurhash/photo.png", http.StatusOK},
+		{time.Second, "/images/resize=11/photo.png", http.StatusOK},
+	}
+	for i, step := range steps {
+		clock.time = clock.time.Add(step.advance)
+		rec := get(s, step.path)
+		if rec.Code != step.want {
+			t.Errorf("step %d %s got status %d, want %d", i, step.path, rec.Code, step.want)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("step %d got Retry-After %q, want 1", i, rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimitIgnoresForwardedForFromUntrustedClients(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) {
+		cfg.RateLimitRPS = 1
+		cfg.RateLimitBurst = 1
+	})
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		rec := get(s, fmt.Sprintf("/images/resize=%d/photo.png", 10+i), "X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		if rec.Code != want {
+			t.Errorf("request %d got status %d, want %d", i, rec.Code, want)
+		}
+	}
+}
+
+func TestRateLimitTrustsForwardedForFromTrustedProxies(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) {
+		cfg.RateLimitRPS = 1
+		cfg.RateLimitBurst = 1
+		cfg.TrustedProxies = []string{"192.0.2.0/24"} // httptest requests come from 192.0.2.1
+	})
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	for i := range 3 {
+		rec := get(s, fmt.Sprintf("/images/resize=%d/photo.png", 10+i), "X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		if rec.Code != http.StatusOK {
+			t.Errorf("client %d got status %d, want 200", i, rec.Code)
+		}
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	clock := &fakeClock{time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.limiter = newRateLimiter(1, 1, clock.now)
+
+	get(s, "/images/resize=10/photo.png") // httptest requests come from 192.0.2.1
+	clock.time = clock.time.Add(limiterIdleTimeout)
+	s.limiter.evictIdle()
+	if _, exists := s.limiter.clients.Load("192.0.2.1"); !exists {
+		t.Fatal("client was forgotten before it was idle")
+	}
+
+	clock.time = clock.time.Add(time.Second)
+	s.limiter.evictIdle()
+	if _, exists := s.limiter.clients.Load("192.0.2.1"); exists {
+		t.Error("idle client was kept")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxRemoteImageSize caps how much of a remote response is downloaded.
+const maxRemoteImageSize = 32 << 20
+
+var errRemoteHostNotAllowed = errors.New("remote host not allowed")
+
+func isRemote(filename string) bool {
+	return strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+}
+
+// maxRemoteRedirects is how many redirects a remote fetch follows.
+const maxRemoteRedirects = 5
+
+// fetchRemoteImage downloads rawURL into the cache directory and returns the local path. The download
+// is reused until it is older than cacheTtl, a ttl of zero keeps it until it is evicted or invalidated.
+// Redirects are only followed to allowed hosts.
+func (s *server) fetchRemoteImage(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if !s.cfg.allowsRemoteHost(u.Hostname()) {
+		return "", errRemoteHostNotAllowed
+	}
+
+	path := s.remoteImagePath(rawURL)
+	if s.remoteImageFresh(path) {
+		s.index.used(path)
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	client := http.Client{
+		Timeout: time.Duration(s.cfg.RemoteTimeout) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRemoteRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRemoteRedirects)
+			}
+			if !s.cfg.allowsRemoteHost(req.URL.Hostname()) {
+				return errRemoteHostNotAllowed
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	written, err := io.Copy(file, io.LimitReader(resp.Body, maxRemoteImageSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if written > maxRemoteImageSize {
+		return "", fmt.Errorf("fetching %s: image is larger than %d bytes", rawURL, maxRemoteImageSize)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(cacheMeta{Filename: rawURL, Created: time.Now(), TTL: s.cfg.CacheTTL})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+metaSuffix, meta, 0644); err != nil {
+		return "", err
+	}
+	s.index.added(path, written+int64(len(meta)))
+	return path, nil
+}
+
+func (s *server) remoteImagePath(rawURL string) string {
+	hash := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(s.cfg.CacheDir, "remote", hex.EncodeToString(hash[:]))
+}
+
+// remoteImageFresh reports whether the download at path is younger than cacheTtl. The download time
+// is kept in a sidecar because serving the file moves its modification time.
+func (s *server) remoteImageFresh(path string) bool {
+	var meta cacheMeta
+	encoded, err := os.ReadFile(path + metaSuffix)
+	if err != nil || json.Unmarshal(encoded, &meta) != nil {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	return !meta.expired(time.Duration(s.cfg.CacheTTL)*time.Second, time.Now())
+}
+
+// clearRemoteImages deletes every downloaded remote image, they stay in the cache
+// directory whichever backend holds the rendered images.
+func (s *server) clearRemoteImages() error {
+	if err := os.RemoveAll(filepath.Join(s.cfg.CacheDir, "remote")); err != nil {
+		return err
+	}
+	if s.index != nil {
+		return s.index.rescan()
+	}
+	return nil
+}
+
+// removeRemoteImage deletes the download of rawURL so the next request fetches it again.
+func (s *server) removeRemoteImage(rawURL string) error {
+	path := s.remoteImagePath(rawURL)
+	s.index.removed(path)
+	var errs []error
+	for _, name := range []string{path, path + metaSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/disintegration/imaging"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// imageServer serves a png at every path and counts the requests it gets.
+func imageServer(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, gradient(40, 30), imaging.PNG); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// remotePath returns the image url for rawURL with its host swapped for localhost.
+func remotePath(operations, rawURL string) string {
+	return "/images/" + operations + "/" + remoteFilename(rawURL)
+}
+
+// remoteFilename escapes rawURL for a path with its host swapped for localhost.
+func remoteFilename(rawURL string) string {
+	return url.PathEscape(strings.Replace(rawURL, "127.0.0.1", "localhost", 1))
+}
+
+func TestRemoteImage(t *testing.T) {
+	var hits atomic.Int32
+	origin := imageServer(t, &hits)
+	s := newTestServer(t, func(cfg *config) { cfg.RemoteHosts = []string{"localhost"} })
+
+	if size := decodeBody(t, get(s, remotePath("resize=20x0", origin.URL+"/photo.png"))).Bounds().Size(); size.X != 20 {
+		t.Errorf("got width %d, want 20", size.X)
+	}
+	if rec := get(s, "/images/resize=20x0/"+url.PathEscape(origin.URL+"/photo.png")); rec.Code != http.StatusForbidden {
+		t.Errorf("host not on the list got status %d, want 403", rec.Code)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("origin was hit %d times, want 1", hits.Load())
+	}
+}
+
+func TestRemoteImageRedirectToDisallowedHost(t *testing.T) {
+	var hits atomic.Int32
+	target := imageServer(t, &hits)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/photo.png", http.StatusFound)
+	}))
+	t.Cleanup(redirector.Close)
+	s := newTestServer(t, func(cfg *config) { cfg.RemoteHosts = []string{"localhost"} })
+
+	if rec := get(s, remotePath("grayscale", redirector.URL+"/photo.png")); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", rec.Code)
+	}
+	if hits.Load() != 0 {
+		t.Errorf("disallowed host was fetched %d times", hits.Load())
+	}
+}
+
+func TestExpiredRemoteImageIsFetchedAgain(t *testing.T) {
+	var hits atomic.Int32
+	origin := imageServer(t, &hits)
+	s := newTestServer(t, func(cfg *config) {
+		cfg.RemoteHosts = []string{"localhost"}
+		cfg.CacheTTL = 60
+		cfg.AdminToken = "secret"
+	})
+	rawURL := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/photo.png"
+
+	decodeBody(t, get(s, remotePath("resize=20x0", rawURL)))
+	decodeBody(t, get(s, remotePath("resize=10x0", rawURL)))
+	if hits.Load() != 1 {
+		t.Fatalf("fresh download was fetched %d times, want 1", hits.Load())
+	}
+
+	meta, err := json.Marshal(cacheMeta{Filename: rawURL, Created: time.Now().Add(-time.Hour), TTL: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.remoteImagePath(rawURL)+metaSuffix, meta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	decodeBody(t, get(s, remotePath("resize=30x0", rawURL)))
+	if hits.Load() != 2 {
+		t.Errorf("expired download was fetched %d times in all, want 2", hits.Load())
+	}
+
+	if rec := request(s, http.MethodDelete, "/cache/"+url.PathEscape(rawURL), "Authorization", "Bearer secret"); rec.Code != http.StatusOK {
+		t.Fatalf("invalidating got status %d: %s", rec.Code, rec.Body)
+	}
+	decodeBody(t, get(s, remotePath("resize=30x0", rawURL)))
+	if hits.Load() != 3 {
+		t.Errorf("invalidated download was fetched %d times in all, want 3", hits.Load())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+type s3Source struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Source(bucket, region, prefix string) (*s3Source, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	return &s3Source{client: s3.NewFromConfig(awsCfg), bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *s3Source) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, name)),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return object.Body, nil
+}
+
+func (s *s3Source) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, name)),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return objectInfo{
+		name:    path.Base(name),
+		size:    aws.ToInt64(head.ContentLength),
+		modTime: aws.ToTime(head.LastModified),
+	}, nil
+}
+
+// s3Error maps missing keys onto os.ErrNotExist so callers can answer with a 404.
+func s3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// objectInfo describes a bucket object as an os.FileInfo.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i objectInfo) Name() string       { return i.name }
+func (i objectInfo) Size() int64        { return i.size }
+func (i objectInfo) Mode() fs.FileMode  { return 0o444 }
+func (i objectInfo) ModTime() time.Time { return i.modTime }
+func (i objectInfo) IsDir() bool        { return false }
+func (i objectInfo) Sys() any           { return nil }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignedURLs(t *testing.T) {
+	s := newTestServer(t, func(cfg *config) { cfg.SignKey = "secret" })
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+
+	signed := signURL("secret", "/images/resize=20,text=Hi there@center@white/photo.png")
+	if !strings.Contains(signed, "%20") {
+		t.Fatalf("signed url %s isn't escaped", signed)
+	}
+	tests := map[string]int{
+		signed: http.StatusOK,
+		signURL("secret", "/info/resize=20/photo.png"):         http.StatusOK,
+		signURL("secret", "/color/photo.png"):                  http.StatusOK,
+		"/images/resize=20/photo.png":                          http.StatusForbidden,
+		"/images/resize=20/photo.png?sig=":                     http.StatusForbidden,
+		"/images/resize=20/photo.png?sig=nothex":               http.StatusForbidden,
+		strings.Replace(signed, "resize=20", "resize=30", 1):   http.StatusForbidden,
+		signURL("other", "/images/resize=20/photo.png"):        http.StatusForbidden,
+		signURL("secret", "/images/resize=20/photo.png") + "0": http.StatusForbidden,
+	}
+	for path, want := range tests {
+		if rec := get(s, path); rec.Code != want {
+			t.Errorf("%s got status %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	// health checks and metrics aren't signed.
+	if rec := get(s, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("healthz got status %d, want 200", rec.Code)
+	}
+}
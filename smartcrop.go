@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"math"
+)
+
+// smartcropAnalysisSize is the longest side of the copy the crop is scored on.
+const smartcropAnalysisSize = 256
+
+// entropyAnalysisSize is the longest side of the copy entropy crops are scored on,
+// and entropyBins the number of luminance levels its histograms count.
+const (
+	entropyAnalysisSize = 128
+	entropyBins         = 32
+)
+
+func (s *server) imageSmartcrop(img image.Image, param string, filter imaging.ResampleFilter) (image.Image, error) {
+	width, height, err := s.parseDimensions(param)
+	if err != nil {
+		return nil, err
+	}
+	region := interestingRegion(img, float64(width)/float64(height))
+	return imaging.Resize(imaging.Crop(img, region), width, height, filter), nil
+}
+
+// interestingRegion returns the largest rectangle with the given aspect ratio
+// that fits in img, placed where the edge energy inside it is highest.
+func interestingRegion(img image.Image, aspect float64) image.Rectangle {
+	bounds := img.Bounds()
+	cropWidth, cropHeight := bounds.Dx(), int(math.Round(float64(bounds.Dx())/aspect))
+	if cropHeight > bounds.Dy() {
+		cropWidth, cropHeight = int(math.Round(float64(bounds.Dy())*aspect)), bounds.Dy()
+	}
+	cropWidth, cropHeight = max(cropWidth, 1), max(cropHeight, 1)
+
+	scale := math.Min(1, smartcropAnalysisSize/float64(max(bounds.Dx(), bounds.Dy())))
+	small := imaging.Resize(img, max(int(float64(bounds.Dx())*scale), 1), max(int(float64(bounds.Dy())*scale), 1), imaging.Box)
+	energy := edgeEnergy(small)
+
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	windowWidth := min(max(int(math.Round(float64(cropWidth)*scale)), 1), w)
+	windowHeight := min(max(int(math.Round(float64(cropHeight)*scale)), 1), h)
+	best, bestX, bestY, bestDistance := -1.0, 0, 0, math.MaxFloat64
+	for y := 0; y+windowHeight <= h; y++ {
+		for x := 0; x+windowWidth <= w; x++ {
+			score := energy[y+windowHeight][x+windowWidth] - energy[y][x+windowWidth] - energy[y+windowHeight][x] + energy[y][x]
+			// ties are broken towards the centre so flat images crop like fill@center
+			distance := math.Hypot(float64(2*x+windowWidth-w), float64(2*y+windowHeight-h))
+			if score > best || (score == best && distance < bestDistance) {
+				best, bestX, bestY, bestDistance = score, x, y, distance
+			}
+		}
+	}
+
+	x := min(int(math.Round(float64(bestX)/scale)), bounds.Dx()-cropWidth)
+	y := min(int(math.Round(float64(bestY)/scale)), bounds.Dy()-cropHeight)
+	return image.Rect(x, y, x+cropWidth, y+cropHeight)
+}
+
+// edgeEnergy returns the summed-area table of the luminance gradient of img,
+// table[y][x] holding the total for the pixels above and left of (x, y).
+func edgeEnergy(img *image.NRGBA) [][]float64 {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	luma := make([]float64, w*h)
+	for i := range luma {
+		p := img.Pix[i*4 : i*4+4]
+		luma[i] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) * float64(p[3]) / 255
+	}
+	at := func(x, y int) float64 {
+		return luma[min(max(y, 0), h-1)*w+min(max(x, 0), w-1)]
+	}
+
+	table := make([][]float64, h+1)
+	table[0] = make([]float64, w+1)
+	for y := 0; y < h; y++ {
+		table[y+1] = make([]float64, w+1)
+		rowSum := 0.0
+		for x := 0; x < w; x++ {
+			rowSum += math.Abs(at(x+1, y)-at(x-1, y)) + math.Abs(at(x, y+1)-at(x, y-1))
+			table[y+1][x+1] = table[y][x+1] + rowSum
+		}
+	}
+	return table
+}
+
+// entropyRegion returns a width x height rectangle inside img, clamped to its bounds,
+// placed where the Shannon entropy of the luminance inside it is highest.
+func entropyRegion(img image.Image, width, height int) image.Rectangle {
+	bounds := img.Bounds()
+	width, height = min(max(width, 1), bounds.Dx()), min(max(height, 1), bounds.Dy())
+
+	scale := math.Min(1, entropyAnalysisSize/float64(max(bounds.Dx(), bounds.Dy())))
+	small := imaging.Resize(img, max(int(float64(bounds.Dx())*scale), 1), max(int(float64(bounds.Dy())*scale), 1), imaging.Box)
+	counts := binCounts(small)
+
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	windowWidth := min(max(int(math.Round(float64(width)*scale)), 1), w)
+	windowHeight := min(max(int(math.Round(float64(height)*scale)), 1), h)
+	total := float64(windowWidth * windowHeight)
+	best, bestX, bestY, bestDistance := -1.0, 0, 0, math.MaxFloat64
+	for y := 0; y+windowHeight <= h; y++ {
+		for x := 0; x+windowWidth <= w; x++ {
+			entropy := 0.0
+			for _, table := range counts {
+				n := table[(y+windowHeight)*(w+1)+x+windowWidth] - table[y*(w+1)+x+windowWidth] - table[(y+windowHeight)*(w+1)+x] + table[y*(w+1)+x]
+				if n > 0 {
+					p := float64(n) / total
+					entropy -= p * math.Log2(p)
+				}
+			}
+			// ties are broken towards the centre so flat images crop like crop@center
+			distance := math.Hypot(float64(2*x+windowWidth-w), float64(2*y+windowHeight-h))
+			if entropy > best || (entropy == best && distance < bestDistance) {
+				best, bestX, bestY, bestDistance = entropy, x, y, distance
+			}
+		}
+	}
+
+	x := bounds.Min.X + min(int(math.Round(float64(bestX)/scale)), bounds.Dx()-width)
+	y := bounds.Min.Y + min(int(math.Round(float64(bestY)/scale)), bounds.Dy()-height)
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// binCounts returns a summed-area table per luminance bin of img, each
+// flattened with a stride of the width plus one.
+func binCounts(img *image.NRGBA) [][]int {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	counts := make([][]int, entropyBins)
+	for bin := range counts {
+		counts[bin] = make([]int, (w+1)*(h+1))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[(y*w+x)*4 : (y*w+x)*4+4]
+			luma := (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) * float64(p[3]) / 255
+			pixelBin := min(int(luma)*entropyBins/256, entropyBins-1)
+			for bin, table := range counts {
+				i := (y+1)*(w+1) + x + 1
+				table[i] = table[i-1] + table[i-w-1] - table[i-w-2]
+				if bin == pixelBin {
+					table[i]++
+				}
+			}
+		}
+	}
+	return counts
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/disintegration/imaging"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// offCenterSubject returns a flat 300x100 image with a detailed 60x60 subject near its right edge.
+func offCenterSubject(t *testing.T) (image.Image, image.Rectangle) {
+	t.Helper()
+	subject, err := imageNoise(gradient(60, 60), "60@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	area := image.Rect(220, 20, 280, 80)
+	return imaging.Paste(imaging.New(300, 100, color.NRGBA{128, 128, 128, 255}), subject, area.Min), area
+}
+
+func TestSmartcropKeepsAnOffCenterSubject(t *testing.T) {
+	img, subject := offCenterSubject(t)
+	if region := interestingRegion(img, 1); !subject.In(region) {
+		t.Errorf("region %v leaves out the subject at %v", region, subject)
+	}
+
+	s := newTestServer(t, nil)
+	cropped, err := s.imageSmartcrop(img, "50x50", imaging.Lanczos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := cropped.Bounds().Size(); size != image.Pt(50, 50) {
+		t.Errorf("got size %v, want 50x50", size)
+	}
+}
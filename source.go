@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errSourceTooLarge  = errors.New("source image is too large")
+	errInvalidFilename = errors.New("invalid filename")
+	errSourceTooBig    = errors.New("source image has too many pixels")
+	errUndecodable     = errors.New("unsupported or corrupt image")
+)
+
+// SourceBackend loads source images by the filename given in the request url.
+// The local image directory is used unless a cloud backend is configured.
+type SourceBackend interface {
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+}
+
+// localSource reads from local directories, the first one holding a file wins.
+type localSource struct {
+	dirs []string
+}
+
+func (s localSource) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	if !filepath.IsLocal(name) {
+		return nil, errInvalidFilename
+	}
+	return os.Open(s.resolve(name))
+}
+
+func (s localSource) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	if !filepath.IsLocal(name) {
+		return nil, errInvalidFilename
+	}
+	return os.Stat(s.resolve(name))
+}
+
+// resolve returns the path of name in the first directory that has it, or in the first directory.
+func (s localSource) resolve(name string) string {
+	for _, dir := range s.dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(s.dirs[0], name)
+}
+
+// filenameMiddleware rejects filenames that would escape the image directories, such as
+// absolute paths or ones climbing out with "..", before any work is done.
+func filenameMiddleware(c *gin.Context) {
+	filename := strings.TrimPrefix(c.Param("filename"), "/")
+	if filename != "" && !isRemote(filename) && !filepath.IsLocal(filename) {
+		abort(c, http.StatusBadRequest, "Invalid filename", errInvalidFilename)
+		c.Abort()
+	}
+}
+
+func newSourceBackend(cfg config) (SourceBackend, error) {
+	if cfg.S3Bucket != "" {
+		return newS3Source(cfg.S3Bucket, cfg.S3Region, cfg.S3Prefix)
+	}
+	return localSource{dirs: cfg.imageDirs()}, nil
+}
+
+// sourceVersion identifies the current contents of a source image by its modification time and size,
+// and returns the modification time. Remote images and sources that can't be found have neither.
+func (s *server) sourceVersion(ctx context.Context, filename string) (string, time.Time) {
+	if isRemote(filename) {
+		return "", time.Time{}
+	}
+	info, err := s.source.Stat(ctx, filename)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), info.ModTime()
+}
+
+// renderVersion is the sourceVersion of filename followed by those of the watermark images in the
+// operations, so replacing any of them renders again. The modification time is the latest of them,
+// and stays zero when filename has none.
+func (s *server) renderVersion(ctx context.Context, filename, operations string) (string, time.Time) {
+	version, modified := s.sourceVersion(ctx, filename)
+	for _, op := range strings.Split(operations, ",") {
+		if opName, opParam := parseOperation(op); opName == "watermark" {
+			markVersion, markModified := s.sourceVersion(ctx, strings.Split(opParam, "@")[0])
+			version += "\x00" + markVersion
+			if !modified.IsZero() && markModified.After(modified) {
+				modified = markModified
+			}
+		}
+	}
+	return version, modified
+}
+
+// readSource reads a source image from the configured backend, or from a remote host when filename is a url.
+// Images over MAX_SOURCE_SIZE_MB are refused with errSourceTooLarge before they are read into memory.
+func (s *server) readSource(ctx context.Context, filename string) ([]byte, error) {
+	maxSize := int64(s.cfg.MaxSourceSizeMB) << 20
+	if isRemote(filename) {
+		path, err := s.fetchRemoteImage(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readLimited(file, maxSize)
+	}
+	info, err := s.source.Stat(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	if maxSize > 0 && info.Size() > maxSize {
+		return nil, errSourceTooLarge
+	}
+	file, err := s.source.Open(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readLimited(file, maxSize)
+}
+
+// readLimited reads r, failing with errSourceTooLarge past maxSize bytes, zero reads everything.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err == nil && int64(len(data)) > maxSize {
+		return nil, errSourceTooLarge
+	}
+	return data, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilenamesCannotEscapeTheImageDirectory(t *testing.T) {
+	root := t.TempDir()
+	s := newTestServer(t, func(cfg *config) { cfg.ImageDir = filepath.Join(root, "images") })
+	if err := os.Mkdir(s.cfg.ImageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	writeImage(t, root, "secret.png", gradient(40, 30))
+
+	if rec := get(s, "/images/grayscale/photo.png"); rec.Code != http.StatusOK {
+		t.Fatalf("image in the directory got status %d", rec.Code)
+	}
+	for _, path := range []string{
+		"/images/grayscale/../secret.png",
+		"/images/grayscale/%2e%2e/secret.png",
+		"/images/grayscale/..%2fsecret.png",
+		"/images/grayscale/" + filepath.Join(root, "secret.png"),
+		"/info/grayscale/../secret.png",
+		"/color/../secret.png",
+		"/blurhash/%2e%2e/secret.png",
+	} {
+		if rec := get(s, path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s got status %d, want %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	for _, name := range []string{"../secret.png", filepath.Join(root, "secret.png")} {
+		if _, err := s.imageWatermark(context.Background(), gradient(40, 30), name+"@center@1"); err == nil {
+			t.Errorf("watermark %s was read", name)
+		}
+		if _, err := s.source.Open(context.Background(), name); !errors.Is(err, errInvalidFilename) {
+			t.Errorf("opening %s got %v, want errInvalidFilename", name, err)
+		}
+	}
+}
+
+func TestFirstImageDirectoryWins(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	s := newTestServer(t, func(cfg *config) { cfg.ImageDirs = []string{first, second} })
+	writeImage(t, first, "photo.png", gradient(40, 30))
+	writeImage(t, second, "photo.png", gradient(80, 60))
+	writeImage(t, second, "other.png", gradient(20, 10))
+
+	tests := map[string]image.Point{
+		"photo.png": image.Pt(40, 30),
+		"other.png": image.Pt(20, 10),
+	}
+	for name, want := range tests {
+		if size := decodeBody(t, get(s, "/images/grayscale/"+name)).Bounds().Size(); size != want {
+			t.Errorf("%s got size %v, want %v", name, size, want)
+		}
+	}
+	if rec := get(s, "/images/grayscale/missing.png"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing image got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestReplacingTheWatermarkRerenders(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(40, 30))
+	writeImage(t, s.cfg.ImageDir, "logo.png", gradient(10, 10))
+
+	const path = "/info/watermark=logo.png@center@1/photo.png"
+	get(s, path)
+	if info := get(s, path); !strings.Contains(info.Body.String(), `"cache_hit":true`) {
+		t.Fatalf("second request wasn't cached: %s", info.Body)
+	}
+	writeImage(t, s.cfg.ImageDir, "logo.png", gradient(20, 20))
+	if info := get(s, path); !strings.Contains(info.Body.String(), `"cache_hit":false`) {
+		t.Errorf("replacing the watermark served the cached image: %s", info.Body)
+	}
+}
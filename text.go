@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// loadFont parses the font at path, then the one at fallback, and uses the
+// bundled Go font when neither is set or loads.
+func loadFont(path, fallback string) (*opentype.Font, error) {
+	for _, path := range []string{path, fallback} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var ttf *opentype.Font
+			if ttf, err = opentype.Parse(data); err == nil {
+				return ttf, nil
+			}
+		}
+		slog.Warn("Failed to load font", "path", path, "error", err)
+	}
+	return opentype.Parse(goregular.TTF)
+}
+
+// operationsParam returns the operations from the escaped request path, a + in the text of
+// a text operation is a space as in a query string while %2B still draws a plus sign.
+func operationsParam(c *gin.Context) string {
+	segments := strings.SplitN(c.Request.URL.EscapedPath(), "/", 4)
+	if len(segments) < 3 {
+		return c.Param("operations")
+	}
+	ops := strings.Split(segments[2], ",")
+	for i, op := range ops {
+		if strings.HasPrefix(op, "text=") {
+			op = strings.ReplaceAll(op, "+", "%20")
+		}
+		if unescaped, err := url.PathUnescape(op); err == nil {
+			ops[i] = unescaped
+		}
+	}
+	return strings.Join(ops, ",")
+}
+
+// maxTextLength is the most characters a text operation may draw.
+const maxTextLength = 200
+
+func (s *server) imageText(img image.Image, param string) (image.Image, error) {
+	parts := strings.Split(param, "@")
+	if len(parts) < 3 || len(parts) > 5 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid text parameters")
+	}
+	if utf8.RuneCountInString(parts[0]) > maxTextLength {
+		return nil, fmt.Errorf("text cannot be longer than %d characters", maxTextLength)
+	}
+	anchor, err := parseAnchor(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	textColor, err := parseColor(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	size := float64(s.cfg.TextSize)
+	if len(parts) > 3 {
+		if size, err = strconv.ParseFloat(parts[3], 64); err != nil || size < 1 || size > 500 {
+			return nil, fmt.Errorf("text size must be between 1 and 500")
+		}
+	}
+	stroke := 0
+	if len(parts) > 4 {
+		if stroke, err = strconv.Atoi(parts[4]); err != nil || stroke < 0 || stroke > 20 {
+			return nil, fmt.Errorf("text stroke must be between 0 and 20")
+		}
+	}
+
+	ttf, err := s.font()
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	label, err := renderText(ttf, parts[0], size, textColor, stroke, bounds.Size())
+	if err != nil {
+		return nil, err
+	}
+	margin := int(size / 2)
+	area := image.Pt(bounds.Dx()-2*margin, bounds.Dy()-2*margin)
+	position := anchorPoint(area, label.Bounds().Size(), anchor).Add(image.Pt(margin, margin))
+	return imaging.Overlay(img, label, position, 1), nil
+}
+
+// renderText draws text onto a transparent label no larger than maxSize, anything past it is cut off.
+func renderText(ttf *opentype.Font, text string, size float64, textColor color.Color, stroke int, maxSize image.Point) (image.Image, error) {
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	text = fitText(face, text, maxSize.X)
+	metrics := face.Metrics()
+	width := min(font.MeasureString(face, text).Ceil()+2*stroke, maxSize.X)
+	height := min((metrics.Ascent+metrics.Descent).Ceil()+2*stroke, maxSize.Y)
+	bounds := image.Rect(0, 0, max(width, 1), max(height, 1))
+
+	mask := image.NewAlpha(bounds)
+	drawer := &font.Drawer{Dst: mask, Src: image.Opaque, Face: face, Dot: fixed.P(stroke, metrics.Ascent.Ceil()+stroke)}
+	drawer.DrawString(text)
+
+	label := image.NewNRGBA(bounds)
+	if stroke > 0 {
+		draw.DrawMask(label, bounds, image.NewUniform(color.Black), image.Point{}, dilate(mask, stroke), image.Point{}, draw.Over)
+	}
+	draw.DrawMask(label, bounds, image.NewUniform(textColor), image.Point{}, mask, image.Point{}, draw.Over)
+	return label, nil
+}
+
+// dilate grows the shape in mask by radius pixels in every direction, each pixel taking
+// the largest value in the disc around it, built from a running maximum along each row.
+func dilate(mask *image.Alpha, radius int) *image.Alpha {
+	width, height := mask.Rect.Dx(), mask.Rect.Dy()
+	out := image.NewAlpha(mask.Rect)
+	row := make([]uint8, width)
+	for dy := -radius; dy <= radius; dy++ {
+		half := int(math.Sqrt(float64(radius*radius - dy*dy)))
+		for y := max(0, -dy); y < min(height, height-dy); y++ {
+			src := mask.Pix[(y+dy)*mask.Stride : (y+dy)*mask.Stride+width]
+			runningMax(row, src, half)
+			dst := out.Pix[y*out.Stride : y*out.Stride+width]
+			for x, value := range row {
+				dst[x] = max(dst[x], value)
+			}
+		}
+	}
+	return out
+}
+
+// runningMax sets dst[x] to the largest of src[x-half] to src[x+half].
+func runningMax(dst, src []uint8, half int) {
+	queue := make([]int, 0, len(src)) // indexes into src with falling values
+	head, next := 0, 0
+	for x := range dst {
+		for ; next < len(src) && next <= x+half; next++ {
+			for len(queue) > head && src[queue[len(queue)-1]] <= src[next] {
+				queue = queue[:len(queue)-1]
+			}
+			queue = append(queue, next)
+		}
+		for queue[head] < x-half {
+			head++
+		}
+		dst[x] = src[queue[head]]
+	}
+}
+
+// fitText drops the characters that would start past width, they'd be cut off anyway.
+func fitText(face font.Face, text string, width int) string {
+	var advance fixed.Int26_6
+	previous := rune(-1)
+	for i, r := range text {
+		if previous >= 0 {
+			advance += face.Kern(previous, r)
+		}
+		if advance.Ceil() > width {
+			return text[:i]
+		}
+		glyphAdvance, _ := face.GlyphAdvance(r)
+		advance += glyphAdvance
+		previous = r
+	}
+	return text
+}
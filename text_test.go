@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestRenderTextIsClippedToTheImage(t *testing.T) {
+	ttf, err := loadFont("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, err := renderText(ttf, strings.Repeat("W", maxTextLength), 500, color.White, 20, image.Pt(50, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := label.Bounds().Size(); size.X > 50 || size.Y > 40 {
+		t.Errorf("label is %v, want at most 50x40", size)
+	}
+}
+
+func TestTextTooLong(t *testing.T) {
+	s := newTestServer(t, nil)
+	if _, err := s.imageText(gradient(50, 50), strings.Repeat("W", maxTextLength+1)+"@center@white"); err == nil {
+		t.Error("expected an error for text over the limit")
+	}
+}
+
+func TestTextPlusIsASpace(t *testing.T) {
+	s := newTestServer(t, nil)
+	writeImage(t, s.cfg.ImageDir, "photo.png", gradient(200, 100))
+
+	plus := get(s, "/images/text=Hello+World@bottom@FFFFFF@24/photo.png")
+	escaped := get(s, "/images/text=Hello%20World@bottom@FFFFFF@24/photo.png")
+	literal := get(s, "/images/text=Hello%2BWorld@bottom@FFFFFF@24/photo.png")
+	decodeBody(t, plus)
+	decodeBody(t, escaped)
+	decodeBody(t, literal)
+	if !bytes.Equal(plus.Body.Bytes(), escaped.Body.Bytes()) {
+		t.Error("a + in the text wasn't drawn as a space")
+	}
+	if bytes.Equal(literal.Body.Bytes(), escaped.Body.Bytes()) {
+		t.Error("%2B in the text was drawn as a space")
+	}
+}